@@ -0,0 +1,126 @@
+package pubkit
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/speier/pubkit/pkg/envelope"
+)
+
+// Child keys are derived from a root private key and a label such as
+// "laptop", "ci" or "project-x", so every device or project gets its own
+// recipient key and the root key recovers all of them. Envelopes sealed with
+// SealForChildren or AppendChildren record the label in the stanza of each
+// child key, which
+// lets OpenWithRoot find the child key to open it with.
+
+// salt of child key derivation, separates child keys from keys derived
+// from a seed
+const childSalt = "pubkit child x25519 v1"
+
+// recipient public key derived from a root key with DeriveChildKeys
+type ChildKey struct {
+	// X25519 public key of the child
+	PubKey []byte
+	// label the child key was derived with, stored in the envelope in clear
+	Label string
+}
+
+// derive child public/private key pair for label from root private key, the
+// same root and label always give the same keys
+func DeriveChildKeys(root []byte, label string) ([]byte, []byte, error) {
+	if len(root) != 32 {
+		return nil, nil, fmt.Errorf("%w: root private key must be 32 bytes", ErrInvalidKey)
+	}
+	if label == "" || len(label) > envelope.MaxLabelSize {
+		return nil, nil, fmt.Errorf("label must be 1 to %d bytes", envelope.MaxLabelSize)
+	}
+	return deriveKeyPair(root, childSalt, label)
+}
+
+// seal data for child keys with options and record their labels, child keys
+// without a label are sealed for as plain recipients, anonymous envelopes
+// cannot record labels
+func SealForChildren(data []byte, opts *SealOptions, children ...*ChildKey) (*envelope.Envelope, error) {
+	labels, pubkeys, err := childLabels(children)
+	if err != nil {
+		return nil, err
+	}
+	return seal(data, opts, labels, pubkeys...)
+}
+
+// open with private key and append child keys with options, recording their
+// labels, child keys without a label are appended as plain recipients
+func AppendChildren(envelope *envelope.Envelope, prvkey []byte, opts *AppendOptions, children ...*ChildKey) (*envelope.Envelope, error) {
+	labels, pubkeys, err := childLabels(children)
+	if err != nil {
+		return nil, err
+	}
+	return appendRecipients(envelope, prvkey, opts, labels, pubkeys...)
+}
+
+// labels keyed by encoded public key and public keys of child keys
+func childLabels(children []*ChildKey) (map[string]string, [][]byte, error) {
+	labels := make(map[string]string)
+	pubkeys := make([][]byte, 0, len(children))
+	for _, c := range children {
+		if c == nil {
+			return nil, nil, errors.New("child key is nil")
+		}
+		if c.Label != "" {
+			labels[b64.EncodeToString(c.PubKey)] = c.Label
+		}
+		pubkeys = append(pubkeys, c.PubKey)
+	}
+	return labels, pubkeys, nil
+}
+
+// open data with the child key of root private key a stanza is labelled
+// with, or with the root key itself
+func OpenWithRoot(envelope *envelope.Envelope, root []byte) ([]byte, error) {
+	return OpenWithRootAndOptions(envelope, root, nil)
+}
+
+// open data with the child key of root private key a stanza is labelled
+// with, or with the root key itself, and options
+func OpenWithRootAndOptions(envelope *envelope.Envelope, root []byte, opts *OpenOptions) ([]byte, error) {
+	if envelope == nil {
+		return nil, errors.New("envelope is nil, must be specified")
+	}
+	if len(root) != 32 {
+		return nil, fmt.Errorf("%w: root private key must be 32 bytes", ErrInvalidKey)
+	}
+
+	tried := make(map[string]bool)
+	for _, r := range envelope.Recipients {
+		if r == nil || r.Label == "" || tried[r.Label] {
+			continue
+		}
+		tried[r.Label] = true
+
+		pubkey, prvkey, err := DeriveChildKeys(root, r.Label)
+		if err != nil {
+			continue
+		}
+		if r.PubKey == b64.EncodeToString(pubkey) {
+			return OpenWithOptions(envelope, prvkey, opts)
+		}
+	}
+
+	return OpenWithOptions(envelope, root, opts)
+}
+
+// label of the child key the stanza addressed to public key was derived
+// with, empty if it has none
+func ChildLabel(envelope *envelope.Envelope, pubkey []byte) string {
+	if envelope == nil {
+		return ""
+	}
+	pk := b64.EncodeToString(pubkey)
+	for _, r := range envelope.Recipients {
+		if r != nil && r.PubKey == pk {
+			return r.Label
+		}
+	}
+	return ""
+}
@@ -0,0 +1,550 @@
+// Command pubkit seals and opens pubkit envelopes.
+//
+//	pubkit keygen [-p] [-f] [-o keyfile]
+//	pubkit seal -r pubkey [-r pubkey...] [-a] [-o out] [file]
+//	pubkit open -i keyfile [-o out] [file]
+//	pubkit update -i keyfile [-a] [-o out] envelope [file]
+//	pubkit append -i keyfile -r pubkey [-r pubkey...] [-a] [-o out] [file]
+//	pubkit inspect [file]
+//
+// Input is read from file or stdin, output written to stdout unless -o is
+// given. With keygen -p the private key is encrypted with the passphrase in
+// the PUBKIT_PASSPHRASE environment variable, which is then also needed to
+// use the key file. keygen does not overwrite an existing key file unless -f
+// is given. Envelopes are read in binary, armored or JSON encoding,
+// written in binary or, with -a, armored encoding. update reads the new data
+// from file or stdin.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/speier/pubkit"
+	"github.com/speier/pubkit/pkg/envelope"
+)
+
+// exit codes by error category
+const (
+	exitOK = iota
+	exitFailure
+	exitUsage
+	exitNoRecipient
+	exitAuthFailed
+	exitMalformed
+	exitUnsupported
+	exitInvalidKey
+	exitPermissionDenied
+)
+
+var errUsage = errors.New("usage")
+
+type command struct {
+	name  string
+	usage string
+	run   func(c *cli, args []string) error
+}
+
+var commands = []*command{
+	{"keygen", "keygen [-p] [-f] [-o keyfile]", keygen},
+	{"seal", "seal -r pubkey [-r pubkey...] [-a] [-o out] [file]", seal},
+	{"open", "open -i keyfile [-o out] [file]", open},
+	{"update", "update -i keyfile [-a] [-o out] envelope [file]", update},
+	{"append", "append -i keyfile -r pubkey [-r pubkey...] [-a] [-o out] [file]", appendRecipients},
+	{"inspect", "inspect [file]", inspect},
+}
+
+type cli struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	getenv func(string) string
+}
+
+// environment variable holding the passphrase of encrypted key files
+const passphraseEnv = "PUBKIT_PASSPHRASE"
+
+// scrypt parameters of key files written by keygen -p
+var keyParams = pubkit.DefaultKeyParams
+
+func main() {
+	c := &cli{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr, getenv: os.Getenv}
+	os.Exit(c.run(os.Args[1:]))
+}
+
+// run command line arguments, returns the exit code
+func (c *cli) run(args []string) int {
+	if len(args) == 0 {
+		c.usage()
+		return exitUsage
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		err := cmd.run(c, args[1:])
+		if err == nil {
+			return exitOK
+		}
+		if errors.Is(err, errUsage) {
+			fmt.Fprintf(c.stderr, "usage: pubkit %s\n", cmd.usage)
+			return exitUsage
+		}
+		fmt.Fprintf(c.stderr, "pubkit %s: %v\n", cmd.name, err)
+		return exitCode(err)
+	}
+
+	c.usage()
+	return exitUsage
+}
+
+func (c *cli) usage() {
+	fmt.Fprintln(c.stderr, "usage:")
+	for _, cmd := range commands {
+		fmt.Fprintf(c.stderr, "  pubkit %s\n", cmd.usage)
+	}
+}
+
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, pubkit.ErrNoMatchingRecipient):
+		return exitNoRecipient
+	case errors.Is(err, pubkit.ErrBodyAuthFailed), errors.Is(err, pubkit.ErrSignatureInvalid),
+		errors.Is(err, pubkit.ErrWrongPassphrase):
+		return exitAuthFailed
+	case errors.Is(err, pubkit.ErrMalformedEnvelope):
+		return exitMalformed
+	case errors.Is(err, pubkit.ErrUnsupportedVersion):
+		return exitUnsupported
+	case errors.Is(err, pubkit.ErrInvalidKey):
+		return exitInvalidKey
+	case errors.Is(err, pubkit.ErrPermissionDenied):
+		return exitPermissionDenied
+	}
+	return exitFailure
+}
+
+func keygen(c *cli, args []string) error {
+	fs := c.flags("keygen")
+	out := fs.String("o", "", "write the key file to `path`")
+	encrypt := fs.Bool("p", false, "encrypt the private key with a passphrase")
+	force := fs.Bool("f", false, "overwrite an existing key file")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	pub, prv, err := pubkit.GenerateKeys()
+	if err != nil {
+		return err
+	}
+	if *encrypt {
+		pass, err := c.passphrase()
+		if err != nil {
+			return err
+		}
+		prv, err = pubkit.EncryptPrivateKeyWithParams(prv, pass, &keyParams)
+		if err != nil {
+			return err
+		}
+	}
+
+	pubs, err := pubkit.EncodePublicKey(pub)
+	if err != nil {
+		return err
+	}
+	prvs := base64.StdEncoding.EncodeToString(prv)
+	if !*encrypt {
+		prvs, err = pubkit.EncodePrivateKey(prv)
+		if err != nil {
+			return err
+		}
+	}
+
+	key := fmt.Sprintf("# public key: %s\n%s\n", pubs, prvs)
+	if *out == "" {
+		_, err = io.WriteString(c.stdout, key)
+		return err
+	}
+	write := createFile
+	if *force {
+		write = writeFile
+	}
+	if err := write(*out, []byte(key), 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stderr, "public key: %s\n", pubs)
+	return nil
+}
+
+func seal(c *cli, args []string) error {
+	fs := c.flags("seal")
+	var recipients keyList
+	fs.Var(&recipients, "r", "seal for recipient `pubkey`, can be repeated")
+	armor := fs.Bool("a", false, "write an armored envelope")
+	out := fs.String("o", "", "write the envelope to `path`")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	if len(recipients) == 0 {
+		return errUsage
+	}
+
+	data, err := c.input(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	env, err := pubkit.Seal(data, recipients...)
+	if err != nil {
+		return err
+	}
+
+	return c.writeEnvelope(*out, env, *armor)
+}
+
+func open(c *cli, args []string) error {
+	fs := c.flags("open")
+	identity := fs.String("i", "", "open with the private key in `keyfile`")
+	out := fs.String("o", "", "write the data to `path`")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	if *identity == "" {
+		return errUsage
+	}
+
+	prv, err := c.readKeyFile(*identity)
+	if err != nil {
+		return err
+	}
+	env, _, err := c.readEnvelope(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	data, err := pubkit.Open(env, prv)
+	if err != nil {
+		return err
+	}
+
+	return c.output(*out, data)
+}
+
+func update(c *cli, args []string) error {
+	fs := c.flags("update")
+	identity := fs.String("i", "", "open with the private key in `keyfile`")
+	armor := fs.Bool("a", false, "write an armored envelope")
+	out := fs.String("o", "", "write the envelope to `path`")
+	if err := parse(fs, args, 2); err != nil {
+		return err
+	}
+	if *identity == "" || fs.NArg() == 0 {
+		return errUsage
+	}
+
+	prv, err := c.readKeyFile(*identity)
+	if err != nil {
+		return err
+	}
+	env, armored, err := readEnvelopeFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	data, err := c.input(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	env, err = pubkit.Update(env, prv, data)
+	if err != nil {
+		return err
+	}
+
+	return c.writeEnvelope(*out, env, *armor || armored)
+}
+
+func appendRecipients(c *cli, args []string) error {
+	fs := c.flags("append")
+	identity := fs.String("i", "", "open with the private key in `keyfile`")
+	var recipients keyList
+	fs.Var(&recipients, "r", "append recipient `pubkey`, can be repeated")
+	armor := fs.Bool("a", false, "write an armored envelope")
+	out := fs.String("o", "", "write the envelope to `path`")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	if *identity == "" || len(recipients) == 0 {
+		return errUsage
+	}
+
+	prv, err := c.readKeyFile(*identity)
+	if err != nil {
+		return err
+	}
+	env, armored, err := c.readEnvelope(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	env, err = pubkit.Append(env, prv, recipients...)
+	if err != nil {
+		return err
+	}
+
+	return c.writeEnvelope(*out, env, *armor || armored)
+}
+
+func inspect(c *cli, args []string) error {
+	fs := c.flags("inspect")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	env, _, err := c.readEnvelope(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(c.stdout)
+	fmt.Fprintf(w, "version:    %s\n", env.Version)
+	if env.Suite != "" {
+		fmt.Fprintf(w, "suite:      %s\n", env.Suite)
+	}
+	fmt.Fprintf(w, "recipients: %d\n", len(env.Recipients))
+	for _, r := range env.Recipients {
+		pub := "(anonymous)"
+		if r.PubKey != "" {
+			pub = keyString(r.PubKey)
+		}
+		attrs := []string{pub}
+		if r.Type != "" {
+			attrs = append(attrs, "type="+r.Type)
+		}
+		if r.Sender != "" {
+			attrs = append(attrs, "sender="+keyString(r.Sender))
+		}
+		if r.Role != "" {
+			attrs = append(attrs, "role="+r.Role)
+		}
+		if r.Identity != "" {
+			attrs = append(attrs, "identity="+r.Identity)
+		}
+		if r.Label != "" {
+			attrs = append(attrs, fmt.Sprintf("label=%q", r.Label))
+		}
+		fmt.Fprintf(w, "  %s\n", strings.Join(attrs, " "))
+	}
+	if env.Signer != "" {
+		fmt.Fprintf(w, "signer:     %s\n", env.Signer)
+	}
+	for _, r := range env.Revocations {
+		fmt.Fprintf(w, "revoked:    %s %s\n", keyString(r.PubKey), r.Time.Format("2006-01-02T15:04:05Z07:00"))
+	}
+	fmt.Fprintf(w, "body:       %d bytes\n", len(env.Body))
+
+	return w.Flush()
+}
+
+// public key string of a key as encoded in envelopes
+func keyString(b64 string) string {
+	key, err := base64.RawStdEncoding.DecodeString(b64)
+	if err != nil {
+		return b64
+	}
+	s, err := pubkit.EncodePublicKey(key)
+	if err != nil {
+		return b64
+	}
+	return s
+}
+
+func (c *cli) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	// usage is printed by run
+	fs.Usage = func() {}
+	return fs
+}
+
+// parse flags and check at most max positional arguments are given
+func parse(fs *flag.FlagSet, args []string, max int) error {
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if fs.NArg() > max {
+		return errUsage
+	}
+	return nil
+}
+
+// read file, or stdin if name is empty or "-"
+func (c *cli) input(name string) ([]byte, error) {
+	if name == "" || name == "-" {
+		return ioutil.ReadAll(c.stdin)
+	}
+	return ioutil.ReadFile(name)
+}
+
+// write data to file, or stdout if name is empty or "-"
+func (c *cli) output(name string, data []byte) error {
+	if name == "" || name == "-" {
+		_, err := c.stdout.Write(data)
+		return err
+	}
+	return writeFile(name, data, 0644)
+}
+
+func (c *cli) readEnvelope(name string) (*envelope.Envelope, bool, error) {
+	data, err := c.input(name)
+	if err != nil {
+		return nil, false, err
+	}
+	return decodeEnvelope(data)
+}
+
+func readEnvelopeFile(name string) (*envelope.Envelope, bool, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, false, err
+	}
+	return decodeEnvelope(data)
+}
+
+// decode binary, armored or JSON envelope, reports whether it was armored
+func decodeEnvelope(data []byte) (*envelope.Envelope, bool, error) {
+	text := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(text, []byte("-----BEGIN")):
+		env, _, err := envelope.Dearmor(data)
+		return env, true, err
+	case bytes.HasPrefix(text, []byte("{")):
+		env := &envelope.Envelope{}
+		return env, false, env.UnmarshalJSON(text)
+	}
+	env := &envelope.Envelope{}
+	return env, false, env.UnmarshalBinary(data)
+}
+
+func (c *cli) writeEnvelope(name string, env *envelope.Envelope, armor bool) error {
+	var data []byte
+	var err error
+	if armor {
+		data, err = envelope.Armor(env, nil)
+	} else {
+		data, err = env.MarshalBinary()
+	}
+	if err != nil {
+		return err
+	}
+	return c.output(name, data)
+}
+
+// write file, replacing it only once it is completely written
+func writeFile(name string, data []byte, perm os.FileMode) error {
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// create file with data, fails if it already exists
+func createFile(name string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+	return err
+}
+
+// read private key from key file, lines starting with # are comments
+func (c *cli) readKeyFile(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if hasKeyPrefix(line) {
+			return pubkit.ParsePrivateKey(line)
+		}
+		key, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(line, "="))
+		if err != nil || len(key) == 32 {
+			return decodeBase64Key(line)
+		}
+
+		// encrypted private key
+		pass, err := c.passphrase()
+		if err != nil {
+			return nil, err
+		}
+		return pubkit.DecryptPrivateKey(key, pass)
+	}
+	return nil, fmt.Errorf("%w: no private key in %s", pubkit.ErrInvalidKey, name)
+}
+
+func (c *cli) passphrase() ([]byte, error) {
+	pass := c.getenv(passphraseEnv)
+	if pass == "" {
+		return nil, fmt.Errorf("passphrase must be set in %s", passphraseEnv)
+	}
+	return []byte(pass), nil
+}
+
+// check if s is a key string rather than a base64 encoded key
+func hasKeyPrefix(s string) bool {
+	return strings.HasPrefix(strings.ToLower(s), "pubkit")
+}
+
+// decode public key string, or base64 key as written by earlier versions
+func decodePublicKey(s string) ([]byte, error) {
+	if hasKeyPrefix(s) {
+		return pubkit.ParsePublicKey(s)
+	}
+	return decodeBase64Key(s)
+}
+
+// decode base64 key, with or without padding
+func decodeBase64Key(s string) ([]byte, error) {
+	key, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%w: %q is not a base64 encoded 32 byte key", pubkit.ErrInvalidKey, s)
+	}
+	return key, nil
+}
+
+// repeatable public key flag
+type keyList [][]byte
+
+func (l *keyList) String() string {
+	keys := make([]string, 0, len(*l))
+	for _, k := range *l {
+		s, _ := pubkit.EncodePublicKey(k)
+		keys = append(keys, s)
+	}
+	return strings.Join(keys, ",")
+}
+
+func (l *keyList) Set(s string) error {
+	key, err := decodePublicKey(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, key)
+	return nil
+}
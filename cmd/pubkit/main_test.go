@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/speier/pubkit"
+)
+
+func runCLI(t *testing.T, stdin []byte, args ...string) ([]byte, int) {
+	return runCLIEnv(t, nil, stdin, args...)
+}
+
+// run with env as the environment
+func runCLIEnv(t *testing.T, env map[string]string, stdin []byte, args ...string) ([]byte, int) {
+	var stdout, stderr bytes.Buffer
+	getenv := func(key string) string { return env[key] }
+	c := &cli{stdin: bytes.NewReader(stdin), stdout: &stdout, stderr: &stderr, getenv: getenv}
+	code := c.run(args)
+	if code != exitOK {
+		t.Logf("pubkit %s: %s", strings.Join(args, " "), stderr.String())
+	}
+	return stdout.Bytes(), code
+}
+
+func TestCLI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubkit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	aKey, bKey := filepath.Join(dir, "a.key"), filepath.Join(dir, "b.key")
+	if _, code := runCLI(t, nil, "keygen", "-o", aKey); code != exitOK {
+		t.Fatalf("keygen: exit %d", code)
+	}
+	out, code := runCLI(t, nil, "keygen")
+	if code != exitOK {
+		t.Fatalf("keygen: exit %d", code)
+	}
+	ioutil.WriteFile(bKey, out, 0600)
+
+	aPub := publicKey(t, aKey)
+	bPub := publicKey(t, bKey)
+
+	if _, code := runCLI(t, nil, "keygen", "-o", aKey); code != exitFailure {
+		t.Errorf("keygen over existing key file: exit %d, want %d", code, exitFailure)
+	}
+	if publicKey(t, aKey) != aPub {
+		t.Fatal("existing key file overwritten")
+	}
+	if _, code := runCLI(t, nil, "keygen", "-f", "-o", bKey); code != exitOK {
+		t.Fatalf("keygen -f: exit %d", code)
+	}
+	if publicKey(t, bKey) == bPub {
+		t.Error("keygen -f did not overwrite key file")
+	}
+	bPub = publicKey(t, bKey)
+
+	want := []byte("hello")
+	sealed, code := runCLI(t, want, "seal", "-a", "-r", aPub)
+	if code != exitOK {
+		t.Fatalf("seal: exit %d", code)
+	}
+	if got, code := runCLI(t, sealed, "open", "-i", aKey); code != exitOK || !bytes.Equal(got, want) {
+		t.Errorf("open: got %q, exit %d", got, code)
+	}
+	if _, code := runCLI(t, sealed, "open", "-i", bKey); code != exitNoRecipient {
+		t.Errorf("open without access: exit %d, want %d", code, exitNoRecipient)
+	}
+
+	appended, code := runCLI(t, sealed, "append", "-i", aKey, "-r", bPub)
+	if code != exitOK {
+		t.Fatalf("append: exit %d", code)
+	}
+	if got, code := runCLI(t, appended, "open", "-i", bKey); code != exitOK || !bytes.Equal(got, want) {
+		t.Errorf("open appended: got %q, exit %d", got, code)
+	}
+
+	env := filepath.Join(dir, "env")
+	ioutil.WriteFile(env, appended, 0644)
+	updated, code := runCLI(t, []byte("bye"), "update", "-i", bKey, env)
+	if code != exitOK {
+		t.Fatalf("update: exit %d", code)
+	}
+	if got, _ := runCLI(t, updated, "open", "-i", aKey); string(got) != "bye" {
+		t.Errorf("open updated: got %q", got)
+	}
+
+	if info, code := runCLI(t, updated, "inspect"); code != exitOK || !bytes.Contains(info, []byte("recipients: 2")) {
+		t.Errorf("inspect: got %q, exit %d", info, code)
+	}
+
+	if _, code := runCLI(t, nil, "seal"); code != exitUsage {
+		t.Errorf("missing recipient: exit %d, want %d", code, exitUsage)
+	}
+	if _, code := runCLI(t, []byte("junk"), "open", "-i", aKey); code != exitMalformed {
+		t.Errorf("junk envelope: exit %d, want %d", code, exitMalformed)
+	}
+}
+
+func TestEncryptedKeyFile(t *testing.T) {
+	// cheap scrypt parameters, the key file records them
+	defer func(p pubkit.KeyParams) { keyParams = p }(keyParams)
+	keyParams = pubkit.KeyParams{LogN: 10, R: 8, P: 1}
+
+	dir, err := ioutil.TempDir("", "pubkit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	env := map[string]string{passphraseEnv: "correct horse"}
+	key := filepath.Join(dir, "a.key")
+	if _, code := runCLIEnv(t, env, nil, "keygen", "-p", "-o", key); code != exitOK {
+		t.Fatalf("keygen -p: exit %d", code)
+	}
+	if data, _ := ioutil.ReadFile(key); bytes.Contains(data, []byte("PUBKIT-SECRET-KEY-")) {
+		t.Fatal("private key written in clear")
+	}
+
+	want := []byte("hello")
+	sealed, code := runCLI(t, want, "seal", "-r", publicKey(t, key))
+	if code != exitOK {
+		t.Fatalf("seal: exit %d", code)
+	}
+	if got, code := runCLIEnv(t, env, sealed, "open", "-i", key); code != exitOK || !bytes.Equal(got, want) {
+		t.Errorf("open: got %q, exit %d", got, code)
+	}
+
+	wrong := map[string]string{passphraseEnv: "wrong horse"}
+	if _, code := runCLIEnv(t, wrong, sealed, "open", "-i", key); code != exitAuthFailed {
+		t.Errorf("wrong passphrase: exit %d, want %d", code, exitAuthFailed)
+	}
+	if _, code := runCLI(t, sealed, "open", "-i", key); code != exitFailure {
+		t.Errorf("unset passphrase: exit %d, want %d", code, exitFailure)
+	}
+	if _, code := runCLI(t, nil, "keygen", "-p"); code != exitFailure {
+		t.Errorf("keygen -p without passphrase: exit %d, want %d", code, exitFailure)
+	}
+}
+
+func publicKey(t *testing.T, keyfile string) string {
+	data, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := strings.SplitN(string(data), "\n", 2)[0]
+	return strings.TrimPrefix(line, "# public key: ")
+}
@@ -0,0 +1,69 @@
+package pubkit
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/speier/pubkit/internal/bip39"
+)
+
+// Keys are derived from a seed with HKDF-SHA256, the salt separates pubkit
+// keys from any other use of the seed and the path separates keys of
+// different purposes, so one mnemonic phrase can regenerate all of them.
+
+// salt of key derivation, a new one makes every derived key different
+const deriveSalt = "pubkit derive x25519 v1"
+
+// minimum seed size in bytes
+const minSeedSize = 16
+
+// generate new 24 word mnemonic phrase
+func GenerateMnemonic() (string, error) {
+	entropy := make([]byte, 32)
+	if _, err := rand.Read(entropy); err != nil {
+		return "", err
+	}
+	return bip39.NewMnemonic(entropy)
+}
+
+// seed of mnemonic phrase and optional passphrase, the phrase is checked
+// for unknown words and its checksum
+func MnemonicSeed(mnemonic, passphrase string) ([]byte, error) {
+	if _, err := bip39.EntropyFromMnemonic(mnemonic); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMnemonic, err)
+	}
+	return bip39.Seed(mnemonic, passphrase), nil
+}
+
+// derive public/private key pair for path from seed, the same seed and path
+// always give the same keys
+func DeriveKeys(seed []byte, path string) ([]byte, []byte, error) {
+	if len(seed) < minSeedSize {
+		return nil, nil, fmt.Errorf("%w: seed must be at least %d bytes", ErrInvalidKey, minSeedSize)
+	}
+	if path == "" {
+		return nil, nil, errors.New("derivation path must be specified")
+	}
+	return deriveKeyPair(seed, deriveSalt, path)
+}
+
+// X25519 key pair derived from secret with HKDF-SHA256
+func deriveKeyPair(secret []byte, salt, info string) ([]byte, []byte, error) {
+	prvkey := make([]byte, curve25519.ScalarSize)
+	kdf := hkdf.New(sha256.New, secret, []byte(salt), []byte(info))
+	if _, err := io.ReadFull(kdf, prvkey); err != nil {
+		return nil, nil, err
+	}
+
+	pubkey, err := curve25519.X25519(prvkey, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pubkey, prvkey, nil
+}
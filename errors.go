@@ -0,0 +1,30 @@
+package pubkit
+
+import (
+	"errors"
+
+	"github.com/speier/pubkit/internal/x25519"
+	"github.com/speier/pubkit/pkg/envelope"
+)
+
+// errors returned by pubkit, use errors.Is to check for them
+var (
+	// none of the recipient stanzas is addressed to the private key
+	ErrNoMatchingRecipient = x25519.ErrNoMatchingRecipient
+	// envelope header or body has been tampered with, or associated data does not match
+	ErrBodyAuthFailed = x25519.ErrBodyAuthFailed
+	// envelope is structurally invalid
+	ErrMalformedEnvelope = envelope.ErrMalformedEnvelope
+	// envelope version or algorithm is not supported
+	ErrUnsupportedVersion = envelope.ErrUnsupportedVersion
+	// public or private key is missing or invalid
+	ErrInvalidKey = x25519.ErrInvalidKey
+	// envelope is not signed or its signature does not verify
+	ErrSignatureInvalid = errors.New("invalid envelope signature")
+	// signer does not hold the role required for a change of a managed envelope
+	ErrPermissionDenied = errors.New("permission denied")
+	// encrypted private key does not decrypt with the passphrase, or has been modified
+	ErrWrongPassphrase = errors.New("wrong passphrase or corrupted key file")
+	// mnemonic phrase has an unknown word, a wrong length or a bad checksum
+	ErrInvalidMnemonic = errors.New("invalid mnemonic phrase")
+)
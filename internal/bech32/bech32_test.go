@@ -0,0 +1,55 @@
+package bech32
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// test vectors from BIP 173
+func TestValid(t *testing.T) {
+	for _, s := range []string{
+		"A12UEL5L",
+		"a12uel5l",
+		"an83characterlonghumanreadablepartthatcontainsthenumber1andtheexcludedcharactersbio1tt5tgs",
+		"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw",
+		"11qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqc8247j",
+		"split1checkupstagehandshakeupstreamerranterredcaperred2y9e3w",
+	} {
+		if _, _, err := Decode(s); err != nil {
+			t.Errorf("%s: %v", s, err)
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	for _, s := range []string{
+		"pzry9x0s0muk",
+		"1pzry9x0s0muk",
+		"x1b4n0q5v",
+		"li1dgmt3",
+		"A1G7SGD8",
+		"10a06t8",
+		"1qzzfhee",
+		"a12UEL5L",
+	} {
+		if _, _, err := Decode(s); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	data := []byte("\x00\x01\x02 some data \xff")
+	s, err := Encode("test", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hrp, got, err := Decode(strings.ToUpper(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hrp != "test" || !bytes.Equal(got, data) {
+		t.Errorf("got %s %x, want test %x", hrp, got, data)
+	}
+}
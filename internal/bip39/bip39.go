@@ -0,0 +1,87 @@
+// Package bip39 implements the mnemonic phrases of BIP 39 with the English
+// wordlist.
+package bip39
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var wordIndex = func() map[string]int {
+	m := make(map[string]int, len(wordlist))
+	for i, w := range wordlist {
+		m[w] = i
+	}
+	return m
+}()
+
+// mnemonic phrase encoding entropy, which must be 16 to 32 bytes in
+// multiples of 4
+func NewMnemonic(entropy []byte) (string, error) {
+	n := len(entropy)
+	if n < 16 || n > 32 || n%4 != 0 {
+		return "", errors.New("bip39: entropy must be 16 to 32 bytes in multiples of 4")
+	}
+
+	// entropy followed by the first n/4 bits of its hash, 11 bits per word
+	sum := sha256.Sum256(entropy)
+	b := append(append([]byte(nil), entropy...), sum[0])
+	words := make([]string, (n*8+n/4)/11)
+	for i := range words {
+		words[i] = wordlist[bits11(b, i*11)]
+	}
+	return strings.Join(words, " "), nil
+}
+
+// entropy encoded by mnemonic phrase, checks the words and the checksum
+func EntropyFromMnemonic(mnemonic string) ([]byte, error) {
+	words := strings.Fields(mnemonic)
+	if len(words) < 12 || len(words) > 24 || len(words)%3 != 0 {
+		return nil, errors.New("bip39: mnemonic must be 12 to 24 words in multiples of 3")
+	}
+
+	b := make([]byte, (len(words)*11+7)/8)
+	for i, w := range words {
+		idx, ok := wordIndex[w]
+		if !ok {
+			return nil, fmt.Errorf("bip39: unknown word %q", w)
+		}
+		for j := 0; j < 11; j++ {
+			if idx&(1<<uint(10-j)) != 0 {
+				pos := i*11 + j
+				b[pos/8] |= 0x80 >> uint(pos%8)
+			}
+		}
+	}
+
+	n := len(words) * 4 / 3
+	entropy, chk := b[:n], b[n]
+	sum := sha256.Sum256(entropy)
+	mask := byte(0xff) << uint(8-n/4)
+	if sum[0]&mask != chk&mask {
+		return nil, errors.New("bip39: invalid checksum")
+	}
+	return entropy, nil
+}
+
+// 64 byte seed of mnemonic phrase and passphrase, the phrase is not checked
+// and the passphrase is used as is, without Unicode normalization
+func Seed(mnemonic, passphrase string) []byte {
+	mnemonic = strings.Join(strings.Fields(mnemonic), " ")
+	return pbkdf2.Key([]byte(mnemonic), []byte("mnemonic"+passphrase), 2048, 64, sha512.New)
+}
+
+// 11 bits of b starting at bit pos
+func bits11(b []byte, pos int) int {
+	v := 0
+	for j := 0; j < 11; j++ {
+		p := pos + j
+		v = v<<1 | int(b[p/8]>>uint(7-p%8)&1)
+	}
+	return v
+}
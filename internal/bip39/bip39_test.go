@@ -0,0 +1,71 @@
+package bip39
+
+import (
+	"bytes"
+	"encoding/hex"
+	"hash/crc32"
+	"testing"
+)
+
+func TestWordlist(t *testing.T) {
+	// crc32 of english.txt from BIP 39
+	if len(wordlist) != 2048 || crc32.ChecksumIEEE([]byte(english)) != 0xc1dbd296 {
+		t.Fatal("wordlist does not match BIP 39")
+	}
+}
+
+// test vectors from BIP 39
+func TestVectors(t *testing.T) {
+	for _, v := range []struct{ entropy, mnemonic, seed string }{
+		{
+			"00000000000000000000000000000000",
+			"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about",
+			"c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04",
+		},
+		{
+			"80808080808080808080808080808080",
+			"letter advice cage absurd amount doctor acoustic avoid letter advice cage above",
+			"d71de856f81a8acc65e6fc851a38d4d7ec216fd0796d0a6827a3ad6ed5511a30fa280f12eb2e47ed2ac03b5c462a0358d18d69fe4f985ec81778c1b370b652a8",
+		},
+		{
+			"7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f",
+			"legal winner thank year wave sausage worth useful legal winner thank year wave sausage worth useful legal will",
+			"f2b94508732bcbacbcc020faefecfc89feafa6649a5491b8c952cede496c214a0c7b3c392d168748f2d4a612bada0753b52a1c7ac53c1e93abd5c6320b9e95dd",
+		},
+		{
+			"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+			"zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo vote",
+			"dd48c104698c30cfe2b6142103248622fb7bb0ff692eebb00089b32d22484e1613912f0a5b694407be899ffd31ed3992c456cdf60f5d4564b8ba3f05a69890ad",
+		},
+	} {
+		entropy, _ := hex.DecodeString(v.entropy)
+		mnemonic, err := NewMnemonic(entropy)
+		if err != nil || mnemonic != v.mnemonic {
+			t.Errorf("%s: got %q, %v", v.entropy, mnemonic, err)
+		}
+		got, err := EntropyFromMnemonic(v.mnemonic)
+		if err != nil || !bytes.Equal(got, entropy) {
+			t.Errorf("%s: got %x, %v", v.entropy, got, err)
+		}
+		if seed := hex.EncodeToString(Seed(v.mnemonic, "TREZOR")); seed != v.seed {
+			t.Errorf("%s: got seed %s", v.entropy, seed)
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	for _, m := range []string{
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon yellow",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abouts",
+		"",
+	} {
+		if _, err := EntropyFromMnemonic(m); err == nil {
+			t.Errorf("%q: expected error", m)
+		}
+	}
+	if _, err := NewMnemonic(make([]byte, 15)); err == nil {
+		t.Error("short entropy: expected error")
+	}
+}
@@ -1,23 +1,115 @@
 package primitives
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
-func EncryptAEAD(key, plaintext []byte) ([]byte, error) {
-	aead, err := chacha20poly1305.New(key)
+// AEAD cipher suite
+type Suite struct {
+	ID        string
+	KeySize   int
+	NonceSize int
+	new       func(key []byte) (cipher.AEAD, error)
+}
+
+var (
+	ChaCha20Poly1305 = &Suite{
+		ID:        "chacha20poly1305",
+		KeySize:   chacha20poly1305.KeySize,
+		NonceSize: chacha20poly1305.NonceSize,
+		new:       chacha20poly1305.New,
+	}
+	XChaCha20Poly1305 = &Suite{
+		ID:        "xchacha20poly1305",
+		KeySize:   chacha20poly1305.KeySize,
+		NonceSize: chacha20poly1305.NonceSizeX,
+		new:       chacha20poly1305.NewX,
+	}
+	AES256GCM = &Suite{
+		ID:        "aes256gcm",
+		KeySize:   32,
+		NonceSize: 12,
+		new:       newAESGCM,
+	}
+)
+
+var suites = []*Suite{ChaCha20Poly1305, XChaCha20Poly1305, AES256GCM}
+
+var errNonceSize = errors.New("invalid nonce size")
+
+// find cipher suite by identifier
+func SuiteByID(id string) (*Suite, error) {
+	for _, s := range suites {
+		if s.ID == id {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown cipher suite %q", id)
+}
+
+// generate random nonce for suite
+func (s *Suite) NewNonce() ([]byte, error) {
+	nonce := make([]byte, s.NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// create AEAD cipher of suite with key
+func (s *Suite) New(key []byte) (cipher.AEAD, error) {
+	if len(key) != s.KeySize {
+		return nil, fmt.Errorf("invalid %s key size", s.ID)
+	}
+	return s.new(key)
+}
+
+func (s *Suite) Encrypt(key, nonce, plaintext, ad []byte) ([]byte, error) {
+	aead, err := s.aead(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, nonce, plaintext, ad), nil
+}
+
+func (s *Suite) Decrypt(key, nonce, ciphertext, ad []byte) ([]byte, error) {
+	aead, err := s.aead(key, nonce)
 	if err != nil {
 		return nil, err
 	}
-	nonce := make([]byte, chacha20poly1305.NonceSize)
-	return aead.Seal(nil, nonce, plaintext, nil), nil
+	return aead.Open(nil, nonce, ciphertext, ad)
+}
+
+func (s *Suite) aead(key, nonce []byte) (cipher.AEAD, error) {
+	if len(nonce) != s.NonceSize {
+		return nil, errNonceSize
+	}
+	return s.New(key)
+}
+
+// encrypt with ChaCha20-Poly1305 and an all-zero nonce, only safe for keys
+// that are never reused
+func EncryptAEAD(key, plaintext, ad []byte) ([]byte, error) {
+	nonce := make([]byte, ChaCha20Poly1305.NonceSize)
+	return ChaCha20Poly1305.Encrypt(key, nonce, plaintext, ad)
+}
+
+// decrypt with ChaCha20-Poly1305 and an all-zero nonce
+func DecryptAEAD(key, ciphertext, ad []byte) ([]byte, error) {
+	nonce := make([]byte, ChaCha20Poly1305.NonceSize)
+	return ChaCha20Poly1305.Decrypt(key, nonce, ciphertext, ad)
 }
 
-func DecryptAEAD(key []byte, ciphertext []byte) ([]byte, error) {
-	aead, err := chacha20poly1305.New(key)
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	nonce := make([]byte, chacha20poly1305.NonceSize)
-	return aead.Open(nil, nonce, ciphertext, nil)
+	return cipher.NewGCM(block)
 }
@@ -0,0 +1,82 @@
+package x25519
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/speier/pubkit/pkg/envelope"
+)
+
+// authcrypt stanzas mix the ephemeral-static and the static-static shared
+// secret of sender and recipient, like NaCl box. A recipient that unwraps
+// such a stanza learns that it was created by the holder of the sender
+// private key, or by itself. Other recipients of the same envelope know the
+// master key, so the body is only attributable to the sender when the
+// envelope has a single recipient.
+
+const authcryptInfo = "pubkit authcrypt"
+
+// derive the wrap key of an authcrypt stanza on the sender side, returns the
+// sender public key and the wrap key
+func authcryptWrapKey(sharedSecret, sender, pubkey, ephemeralPub []byte) ([]byte, []byte, error) {
+	senderPub, err := curve25519.X25519(sender, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+
+	staticSecret, err := getSharedSecret(sender, pubkey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+
+	wrapKey, err := deriveAuthcryptWrapKey(sharedSecret, staticSecret, ephemeralPub, pubkey, senderPub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return senderPub, wrapKey, nil
+}
+
+// derive the wrap key of authcrypt stanza r on the recipient side
+func authcryptUnwrapKey(sharedSecret, prvkey, pubkey, ephemeralPub []byte, r *envelope.Recipient) ([]byte, error) {
+	senderPub, err := b64.DecodeString(r.Sender)
+	if err != nil {
+		return nil, malformed("sender public key: %v", err)
+	}
+
+	staticSecret, err := getSharedSecret(prvkey, senderPub)
+	if err != nil {
+		return nil, malformed("sender public key: %v", err)
+	}
+
+	return deriveAuthcryptWrapKey(sharedSecret, staticSecret, ephemeralPub, pubkey, senderPub)
+}
+
+// check if stanza is authcrypted with sender public key
+func authcryptedBy(r *envelope.Recipient, senderPub []byte) bool {
+	return r.Type == envelope.TypeAuthcrypt && r.Sender == b64.EncodeToString(senderPub)
+}
+
+func deriveAuthcryptWrapKey(sharedSecret, staticSecret, ephemeralPub, pubkey, senderPub []byte) ([]byte, error) {
+	secret := make([]byte, 0, len(sharedSecret)+len(staticSecret))
+	secret = append(secret, sharedSecret...)
+	secret = append(secret, staticSecret...)
+
+	salt := make([]byte, 0, len(ephemeralPub)+len(pubkey)+len(senderPub))
+	salt = append(salt, ephemeralPub...)
+	salt = append(salt, pubkey...)
+	salt = append(salt, senderPub...)
+
+	h := hkdf.New(sha256.New, secret, salt, []byte(authcryptInfo))
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
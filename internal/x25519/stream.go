@@ -0,0 +1,484 @@
+package x25519
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/speier/pubkit/pkg/envelope"
+)
+
+// The body of v4 envelopes is encrypted with the STREAM construction: the
+// plaintext is split into chunks of chunkSize bytes, the last one possibly
+// shorter, each encrypted under the nonce
+//
+//	prefix || 4 byte big-endian chunk counter || last chunk flag
+//
+// where the prefix is stored in the envelope nonce field. Reordered chunks
+// fail to decrypt because of the counter, a truncated body because its new
+// last chunk was not encrypted with the last chunk flag set.
+
+// plaintext size of a body chunk
+const chunkSize = 64 * 1024
+
+// size of chunk counter and last chunk flag following the nonce prefix
+const streamNonceSize = 5
+
+var errTruncated = fmt.Errorf("%w: body has been truncated or tampered with", ErrBodyAuthFailed)
+
+// start sealing a v4 envelope to w, the envelope header is written right
+// away, the returned writer encrypts the body and must be closed to write
+// the last chunk
+func SealStream(w io.Writer, opts *Options, pubkey ...[]byte) (io.WriteCloser, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	_, env, masterKey, err := newEnvelope(envelope.V4, opts, pubkey...)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := beginV4(env, masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := env.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return newStreamWriter(w, aead, env.Nonce, opts.AD), nil
+}
+
+// read a v4 envelope header from r and open it with private key, the
+// returned reader decrypts the body as it is read from r
+func OpenStream(r io.Reader, prvkey []byte, opts *Options) (io.Reader, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	env, err := envelope.ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if env.Version != envelope.V4 {
+		return nil, fmt.Errorf("%w: version %s envelopes cannot be streamed", envelope.ErrUnsupportedVersion, env.Version)
+	}
+
+	_, masterKey, _, err := unlock(env, prvkey, opts)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := bodyCipher(env, masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return newStreamReader(r, aead, env.Nonce, opts.AD), nil
+}
+
+// v4: like v3, but the body is encrypted in chunks and the envelope nonce
+// is the prefix of the chunk nonces
+
+func validateV4(env *envelope.Envelope) error {
+	suite, err := suiteOf(env)
+	if err != nil {
+		return err
+	}
+	if len(env.MAC) != sha256.Size {
+		return malformed("invalid header MAC")
+	}
+	if len(env.Nonce) != suite.NonceSize-streamNonceSize {
+		return malformed("invalid body nonce")
+	}
+	return validateRecipients(env, suite.NonceSize)
+}
+
+func sealV4(env *envelope.Envelope, masterKey, data, ad []byte) error {
+	aead, err := beginV4(env, masterKey)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	w := newStreamWriter(&body, aead, env.Nonce, ad)
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	env.Body = body.Bytes()
+
+	return nil
+}
+
+func openV4(env *envelope.Envelope, masterKey, ad []byte) ([]byte, error) {
+	aead, err := bodyCipher(env, masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(newStreamReader(bytes.NewReader(env.Body), aead, env.Nonce, ad))
+}
+
+// pick the chunk nonce prefix and authenticate the header of a v4
+// envelope, returns the body cipher
+func beginV4(env *envelope.Envelope, masterKey []byte) (cipher.AEAD, error) {
+	suite, err := suiteOf(env)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := suite.NewNonce()
+	if err != nil {
+		return nil, err
+	}
+	env.Nonce = nonce[:suite.NonceSize-streamNonceSize]
+
+	env.MAC, err = headerMAC(env, masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return bodyCipher(env, masterKey)
+}
+
+// body cipher of envelope, keyed from the master key
+func bodyCipher(env *envelope.Envelope, masterKey []byte) (cipher.AEAD, error) {
+	suite, err := suiteOf(env)
+	if err != nil {
+		return nil, err
+	}
+	bodyKey, err := deriveKey(masterKey, bodyKeyInfo+env.Version)
+	if err != nil {
+		return nil, err
+	}
+	return suite.New(bodyKey)
+}
+
+// nonce of chunk number counter
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, len(prefix)+streamNonceSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[len(prefix):], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+type streamWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	ad     []byte
+
+	buf     []byte
+	out     []byte
+	counter uint32
+	err     error
+}
+
+func newStreamWriter(w io.Writer, aead cipher.AEAD, prefix, ad []byte) *streamWriter {
+	return &streamWriter{
+		w:      w,
+		aead:   aead,
+		prefix: prefix,
+		ad:     ad,
+		buf:    make([]byte, 0, chunkSize),
+		out:    make([]byte, 0, chunkSize+aead.Overhead()),
+	}
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if s.err != nil {
+			return n, s.err
+		}
+		// a full chunk is only written once more data follows, so the last
+		// chunk is known when closing
+		if len(s.buf) == chunkSize {
+			s.err = s.flush(false)
+			continue
+		}
+
+		m := chunkSize - len(s.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		s.buf = append(s.buf, p[:m]...)
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+// write the last chunk, the underlying writer is not closed
+func (s *streamWriter) Close() error {
+	if s.err != nil {
+		return s.err
+	}
+	s.err = s.flush(true)
+	if s.err != nil {
+		return s.err
+	}
+	s.err = errors.New("stream is closed")
+	return nil
+}
+
+func (s *streamWriter) flush(last bool) error {
+	if !last && s.counter == 1<<32-1 {
+		return errors.New("stream too long")
+	}
+
+	s.out = s.aead.Seal(s.out[:0], chunkNonce(s.prefix, s.counter, last), s.buf, s.ad)
+	if _, err := s.w.Write(s.out); err != nil {
+		return err
+	}
+
+	s.buf = s.buf[:0]
+	s.counter++
+	return nil
+}
+
+type streamReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	ad     []byte
+
+	buf     []byte
+	plain   []byte
+	next    []byte
+	counter uint32
+	done    bool
+	err     error
+}
+
+func newStreamReader(r io.Reader, aead cipher.AEAD, prefix, ad []byte) *streamReader {
+	return &streamReader{
+		r:      r,
+		aead:   aead,
+		prefix: prefix,
+		ad:     ad,
+		// one byte more than a chunk, to find out whether another follows
+		buf: make([]byte, chunkSize+aead.Overhead()+1),
+	}
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.done {
+			return 0, io.EOF
+		}
+		s.err = s.readChunk()
+	}
+
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+func (s *streamReader) readChunk() error {
+	// carry over the byte read ahead of the previous chunk
+	n := copy(s.buf, s.next)
+	m, err := io.ReadFull(s.r, s.buf[n:])
+	n += m
+
+	size := len(s.buf) - 1
+	last := false
+	switch err {
+	case nil:
+		s.next = append(s.next[:0], s.buf[size])
+	case io.EOF, io.ErrUnexpectedEOF:
+		last, size = true, n
+	default:
+		return err
+	}
+	if size < s.aead.Overhead() {
+		return errTruncated
+	}
+
+	plain, err := s.aead.Open(s.buf[:0], chunkNonce(s.prefix, s.counter, last), s.buf[:size], s.ad)
+	if err != nil {
+		if last {
+			return errTruncated
+		}
+		return errBodyAuth
+	}
+	if !last && s.counter == 1<<32-1 {
+		return malformed("body too long")
+	}
+
+	s.plain = plain
+	s.counter++
+	s.done = last
+	return nil
+}
+
+// open a v4 envelope of size bytes read from r with private key, chunks
+// are decrypted and verified as they are read, so the returned reader
+// supports random access
+func OpenStreamAt(r io.ReaderAt, size int64, prvkey []byte, opts *Options) (*io.SectionReader, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	sr := io.NewSectionReader(r, 0, size)
+	env, err := envelope.ReadHeader(sr)
+	if err != nil {
+		return nil, err
+	}
+	if env.Version != envelope.V4 {
+		return nil, fmt.Errorf("%w: version %s envelopes cannot be streamed", envelope.ErrUnsupportedVersion, env.Version)
+	}
+	offset, err := sr.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	_, masterKey, _, err := unlock(env, prvkey, opts)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := bodyCipher(env, masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := newChunkReader(r, aead, env.Nonce, opts.AD, offset, size-offset)
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(c, 0, c.size), nil
+}
+
+// random access to the chunks of a v4 body
+type chunkReader struct {
+	r      io.ReaderAt
+	aead   cipher.AEAD
+	prefix []byte
+	ad     []byte
+
+	// offset of the body in r
+	offset int64
+	// number of chunks and ciphertext size of the last one
+	chunks   int64
+	lastSize int64
+	// plaintext size
+	size int64
+
+	mu     sync.Mutex
+	buf    []byte
+	cached int64
+	plain  []byte
+}
+
+func newChunkReader(r io.ReaderAt, aead cipher.AEAD, prefix, ad []byte, offset, body int64) (*chunkReader, error) {
+	overhead := int64(aead.Overhead())
+	sealed := int64(chunkSize) + overhead
+	if body < overhead {
+		return nil, errTruncated
+	}
+
+	chunks := (body + sealed - 1) / sealed
+	if chunks > 1<<32 {
+		return nil, malformed("body too long")
+	}
+	lastSize := body - (chunks-1)*sealed
+	if lastSize < overhead {
+		return nil, errTruncated
+	}
+
+	c := &chunkReader{
+		r:        r,
+		aead:     aead,
+		prefix:   prefix,
+		ad:       ad,
+		offset:   offset,
+		chunks:   chunks,
+		lastSize: lastSize,
+		size:     body - chunks*overhead,
+		buf:      make([]byte, sealed),
+		cached:   -1,
+	}
+
+	// the last chunk authenticates the body size, check it up front so a
+	// truncated body is detected before any read
+	if _, err := c.chunk(chunks - 1); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *chunkReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for n < len(p) && off < c.size {
+		i := off / chunkSize
+		plain, err := c.chunk(i)
+		if err != nil {
+			return n, err
+		}
+		m := copy(p[n:], plain[off-i*chunkSize:])
+		n += m
+		off += int64(m)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// decrypt chunk i, the last decrypted chunk is kept for sequential reads
+func (c *chunkReader) chunk(i int64) ([]byte, error) {
+	if i == c.cached {
+		return c.plain, nil
+	}
+	c.cached = -1
+
+	last := i == c.chunks-1
+	buf := c.buf
+	if last {
+		buf = c.buf[:c.lastSize]
+	}
+	n, err := c.r.ReadAt(buf, c.offset+i*int64(len(c.buf)))
+	if n < len(buf) {
+		if err == io.EOF || err == nil {
+			return nil, errTruncated
+		}
+		return nil, err
+	}
+
+	plain, err := c.aead.Open(buf[:0], chunkNonce(c.prefix, uint32(i), last), buf, c.ad)
+	if err != nil {
+		if last {
+			return nil, errTruncated
+		}
+		return nil, errBodyAuth
+	}
+
+	c.cached, c.plain = i, plain
+	return plain, nil
+}
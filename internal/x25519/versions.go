@@ -0,0 +1,340 @@
+package x25519
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/speier/pubkit/internal/primitives"
+	"github.com/speier/pubkit/pkg/envelope"
+)
+
+// format implements the cryptographic operations of an envelope version
+type format struct {
+	// check envelope structure before any cryptographic operation
+	validate func(env *envelope.Envelope) error
+	// wrap the master key into recipient stanza
+	wrap func(env *envelope.Envelope, wrapKey, masterKey []byte, r *envelope.Recipient) error
+	// unwrap the master key from recipient stanza
+	unwrap func(env *envelope.Envelope, wrapKey []byte, r *envelope.Recipient) ([]byte, error)
+	// encrypt body and authenticate header with the master key
+	seal func(env *envelope.Envelope, masterKey, data, ad []byte) error
+	// decrypt body with the master key, the header is verified by unlock
+	open func(env *envelope.Envelope, masterKey, ad []byte) ([]byte, error)
+	// header MAC of the envelope, nil for versions without one
+	header func(env *envelope.Envelope, masterKey []byte) ([]byte, error)
+}
+
+// version written by Seal, V4 is newer but only written by the stream
+// writer as its chunked body needs a streaming reader to pay off
+const defaultVersion = envelope.V3
+
+// cipher suite of v3 envelopes without a suite identifier
+var defaultSuite = primitives.XChaCha20Poly1305
+
+var formats = map[string]*format{}
+
+func init() {
+	register(envelope.V1, &format{
+		validate: validateV1,
+		wrap:     wrapV1,
+		unwrap:   unwrapV1,
+		seal:     sealV1,
+		open:     openV1,
+		header:   headerV1,
+	})
+	register(envelope.V2, &format{
+		validate: validateV2,
+		wrap:     wrapV1,
+		unwrap:   unwrapV1,
+		seal:     sealV2,
+		open:     openV2,
+		header:   headerMAC,
+	})
+	register(envelope.V3, &format{
+		validate: validateV3,
+		wrap:     wrapV3,
+		unwrap:   unwrapV3,
+		seal:     sealV3,
+		open:     openV3,
+		header:   headerMAC,
+	})
+	register(envelope.V4, &format{
+		validate: validateV4,
+		wrap:     wrapV3,
+		unwrap:   unwrapV3,
+		seal:     sealV4,
+		open:     openV4,
+		header:   headerMAC,
+	})
+
+	// the versions of the envelope package are the registry, each needs a
+	// format
+	for _, v := range envelope.Versions() {
+		if _, ok := formats[v]; !ok {
+			panic("x25519: no format for version " + v)
+		}
+	}
+}
+
+func register(version string, f *format) {
+	if !envelope.Supported(version) {
+		panic("x25519: format of unknown version: " + version)
+	}
+	if _, ok := formats[version]; ok {
+		panic("x25519: format registered twice: " + version)
+	}
+	formats[version] = f
+}
+
+func lookup(version string) (*format, error) {
+	f, ok := formats[version]
+	if !ok {
+		return nil, &envelope.UnsupportedVersionError{Version: version}
+	}
+	return f, nil
+}
+
+// v1: master key and body are encrypted with an all-zero nonce, the body
+// directly with the master key and the header is not authenticated
+
+func validateV1(env *envelope.Envelope) error {
+	if env.Suite != "" || len(env.Nonce) > 0 || len(env.MAC) > 0 {
+		return malformed("unexpected field for version %s", env.Version)
+	}
+	return validateRecipients(env, 0)
+}
+
+func wrapV1(env *envelope.Envelope, wrapKey, masterKey []byte, r *envelope.Recipient) error {
+	docKey, err := primitives.EncryptAEAD(wrapKey, masterKey, nil)
+	if err != nil {
+		return err
+	}
+	r.DocKey = docKey
+	return nil
+}
+
+func unwrapV1(env *envelope.Envelope, wrapKey []byte, r *envelope.Recipient) ([]byte, error) {
+	return primitives.DecryptAEAD(wrapKey, r.DocKey, nil)
+}
+
+func sealV1(env *envelope.Envelope, masterKey, data, ad []byte) error {
+	body, err := primitives.EncryptAEAD(masterKey, data, ad)
+	if err != nil {
+		return err
+	}
+	env.Body = body
+	return nil
+}
+
+func openV1(env *envelope.Envelope, masterKey, ad []byte) ([]byte, error) {
+	data, err := primitives.DecryptAEAD(masterKey, env.Body, ad)
+	if err != nil {
+		return nil, errBodyAuth
+	}
+	return data, nil
+}
+
+func headerV1(env *envelope.Envelope, masterKey []byte) ([]byte, error) {
+	return nil, nil
+}
+
+// v2: the body key is derived from the master key and the header is
+// authenticated with a MAC keyed from the master key
+
+func validateV2(env *envelope.Envelope) error {
+	if env.Suite != "" || len(env.Nonce) > 0 {
+		return malformed("unexpected field for version %s", env.Version)
+	}
+	if len(env.MAC) != sha256.Size {
+		return malformed("invalid header MAC")
+	}
+	return validateRecipients(env, 0)
+}
+
+func sealV2(env *envelope.Envelope, masterKey, data, ad []byte) error {
+	bodyKey, err := deriveKey(masterKey, bodyKeyInfo+env.Version)
+	if err != nil {
+		return err
+	}
+	env.Body, err = primitives.EncryptAEAD(bodyKey, data, ad)
+	if err != nil {
+		return err
+	}
+
+	env.MAC, err = headerMAC(env, masterKey)
+	return err
+}
+
+func openV2(env *envelope.Envelope, masterKey, ad []byte) ([]byte, error) {
+
+	bodyKey, err := deriveKey(masterKey, bodyKeyInfo+env.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := primitives.DecryptAEAD(bodyKey, env.Body, ad)
+	if err != nil {
+		return nil, errBodyAuth
+	}
+	return data, nil
+}
+
+// v3: like v2, but master key and body are encrypted with the cipher suite
+// recorded in the envelope under random nonces stored in the envelope
+
+func validateV3(env *envelope.Envelope) error {
+	suite, err := suiteOf(env)
+	if err != nil {
+		return err
+	}
+	if len(env.MAC) != sha256.Size {
+		return malformed("invalid header MAC")
+	}
+	if len(env.Nonce) != suite.NonceSize {
+		return malformed("invalid body nonce")
+	}
+	return validateRecipients(env, suite.NonceSize)
+}
+
+func wrapV3(env *envelope.Envelope, wrapKey, masterKey []byte, r *envelope.Recipient) error {
+	suite, err := suiteOf(env)
+	if err != nil {
+		return err
+	}
+	nonce, err := suite.NewNonce()
+	if err != nil {
+		return err
+	}
+	docKey, err := suite.Encrypt(wrapKey, nonce, masterKey, nil)
+	if err != nil {
+		return err
+	}
+	r.Nonce, r.DocKey = nonce, docKey
+	return nil
+}
+
+func unwrapV3(env *envelope.Envelope, wrapKey []byte, r *envelope.Recipient) ([]byte, error) {
+	suite, err := suiteOf(env)
+	if err != nil {
+		return nil, err
+	}
+	return suite.Decrypt(wrapKey, r.Nonce, r.DocKey, nil)
+}
+
+func sealV3(env *envelope.Envelope, masterKey, data, ad []byte) error {
+	suite, err := suiteOf(env)
+	if err != nil {
+		return err
+	}
+	bodyKey, err := deriveKey(masterKey, bodyKeyInfo+env.Version)
+	if err != nil {
+		return err
+	}
+	env.Nonce, err = suite.NewNonce()
+	if err != nil {
+		return err
+	}
+	env.Body, err = suite.Encrypt(bodyKey, env.Nonce, data, ad)
+	if err != nil {
+		return err
+	}
+
+	env.MAC, err = headerMAC(env, masterKey)
+	return err
+}
+
+func openV3(env *envelope.Envelope, masterKey, ad []byte) ([]byte, error) {
+	suite, err := suiteOf(env)
+	if err != nil {
+		return nil, err
+	}
+
+	bodyKey, err := deriveKey(masterKey, bodyKeyInfo+env.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := suite.Decrypt(bodyKey, env.Nonce, env.Body, ad)
+	if err != nil {
+		return nil, errBodyAuth
+	}
+	return data, nil
+}
+
+// cipher suite of v3 envelope
+func suiteOf(env *envelope.Envelope) (*primitives.Suite, error) {
+	if env.Suite == "" {
+		return defaultSuite, nil
+	}
+	suite, err := primitives.SuiteByID(env.Suite)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", envelope.ErrUnsupportedVersion, err)
+	}
+	return suite, nil
+}
+
+// check recipient stanzas carry well-formed keys and nonces of nonceSize
+func validateRecipients(env *envelope.Envelope, nonceSize int) error {
+	for _, r := range env.Recipients {
+		if r == nil {
+			return malformed("recipient is nil")
+		}
+		if r.PubKey != "" {
+			if k, err := b64.DecodeString(r.PubKey); err != nil || len(k) != keySize {
+				return malformed("invalid recipient public key")
+			}
+		}
+		if k, err := b64.DecodeString(r.EPubKey); err != nil || len(k) != keySize {
+			return malformed("invalid ephemeral public key")
+		}
+		switch r.Type {
+		case "":
+			if r.Sender != "" {
+				return malformed("unexpected recipient sender")
+			}
+		case envelope.TypeAuthcrypt:
+			if k, err := b64.DecodeString(r.Sender); err != nil || len(k) != keySize {
+				return malformed("invalid recipient sender public key")
+			}
+		default:
+			return fmt.Errorf("%w: recipient type %q", envelope.ErrUnsupportedVersion, r.Type)
+		}
+		switch r.Role {
+		case "", envelope.RoleReader:
+		case envelope.RoleWriter, envelope.RoleAdmin:
+			if r.Identity == "" {
+				return malformed("missing identity for role %s", r.Role)
+			}
+		default:
+			return fmt.Errorf("%w: recipient role %q", envelope.ErrUnsupportedVersion, r.Role)
+		}
+		if r.Identity != "" {
+			if k, err := b64.DecodeString(r.Identity); err != nil || len(k) != keySize {
+				return malformed("invalid recipient identity")
+			}
+		}
+		if len(r.Label) > envelope.MaxLabelSize || (r.Label != "" && r.PubKey == "") {
+			return malformed("invalid recipient label")
+		}
+		if len(r.Nonce) != nonceSize {
+			return malformed("invalid recipient nonce")
+		}
+		if len(r.DocKey) == 0 {
+			return malformed("missing recipient key")
+		}
+	}
+	return nil
+}
+
+// verify the header MAC of envelope, if its version has one
+func verifyHeader(f *format, env *envelope.Envelope, masterKey []byte) error {
+	mac, err := f.header(env, masterKey)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, env.MAC) {
+		return errHeaderTampered
+	}
+	return nil
+}
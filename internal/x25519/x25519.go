@@ -2,23 +2,80 @@ package x25519
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/hkdf"
 
-	"github.com/speier/pubkit/internal/primitives"
 	"github.com/speier/pubkit/pkg/envelope"
 )
 
 const keySize = 32
 
+// HKDF info strings separating the keys derived from the master key
+const (
+	bodyKeyInfo   = "pubkit body key "
+	headerKeyInfo = "pubkit header key "
+)
+
+var (
+	// none of the recipient stanzas is addressed to the private key
+	ErrNoMatchingRecipient = errors.New("no matching recipient")
+	// header or body failed authentication
+	ErrBodyAuthFailed = errors.New("envelope authentication failed")
+	// public or private key is not a valid X25519 key
+	ErrInvalidKey = errors.New("invalid key")
+)
+
+var (
+	errHeaderTampered = fmt.Errorf("%w: header has been tampered with", ErrBodyAuthFailed)
+	errBodyAuth       = fmt.Errorf("%w: body has been tampered with or associated data does not match", ErrBodyAuthFailed)
+)
+
 var b64 = base64.RawStdEncoding.Strict()
 
+// options for sealing and opening envelopes
+type Options struct {
+	// associated data, authenticated but not stored in the envelope
+	AD []byte
+	// cipher suite identifier, defaults to the suite of the default version
+	Suite string
+	// try every stanza without a public key when none is addressed to the
+	// private key, costs a key agreement per stanza
+	TrialDecrypt bool
+	// omit recipient public keys from the stanzas
+	Anonymous bool
+	// recipient public keys of anonymous stanzas, which the envelope does
+	// not reveal, needed to reseal anonymous envelopes
+	Recipients [][]byte
+	// sender private key, seals authcrypt stanzas that prove to each
+	// recipient that the sender holds it
+	Sender []byte
+	// sender public key the stanza opened must be authcrypted with
+	ExpectSender []byte
+	// roles granted to recipients, keyed by encoded recipient public key
+	Grants map[string]*Grant
+	// labels of the child keys recipients were derived with, keyed by
+	// encoded recipient public key, not allowed in anonymous envelopes
+	Labels map[string]string
+	// removed recipients recorded in the envelope
+	Revocations []*envelope.Revocation
+}
+
+// role granted to a recipient
+type Grant struct {
+	Role string
+	// encoded Ed25519 public key of the recipient
+	Identity string
+}
+
 // generate new public/private key pair
 func GenerateKeys() ([]byte, []byte, error) {
 	prvkey := make([]byte, curve25519.ScalarSize)
@@ -36,136 +93,570 @@ func GenerateKeys() ([]byte, []byte, error) {
 }
 
 // seal data with recipients public key
-func Seal(data []byte, pubkey ...[]byte) (*envelope.Envelope, error) {
-	masterKey := make([]byte, keySize)
-	_, err := rand.Read(masterKey)
+func Seal(data []byte, opts *Options, pubkey ...[]byte) (*envelope.Envelope, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	f, env, masterKey, err := newEnvelope(defaultVersion, opts, pubkey...)
 	if err != nil {
 		return nil, err
 	}
 
-	recipients := make([]*envelope.Recipient, 0)
+	if err := f.seal(env, masterKey, data, opts.AD); err != nil {
+		return nil, err
+	}
+
+	return env, nil
+}
+
+// create envelope of version with a new master key wrapped for recipients
+// public key, the body is left empty
+func newEnvelope(version string, opts *Options, pubkey ...[]byte) (*format, *envelope.Envelope, []byte, error) {
+	f, err := lookup(version)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	env := envelope.NewEnvelope(version, nil, nil)
+	env.Suite = opts.Suite
+	if env.Suite == "" {
+		env.Suite = defaultSuite.ID
+	}
+	if _, err := suiteOf(env); err != nil {
+		return nil, nil, nil, err
+	}
 	for _, rpubkey := range pubkey {
-		ephemeralPub, ephemeralPrv, err := GenerateKeys()
-		if err != nil {
-			return nil, err
+		if len(rpubkey) != keySize {
+			return nil, nil, nil, fmt.Errorf("%w: public key must be %d bytes", ErrInvalidKey, keySize)
 		}
+	}
+	if opts.Sender != nil && len(opts.Sender) != keySize {
+		return nil, nil, nil, fmt.Errorf("%w: sender private key must be %d bytes", ErrInvalidKey, keySize)
+	}
+	if err := checkLabels(opts.Labels, opts.Anonymous); err != nil {
+		return nil, nil, nil, err
+	}
+
+	masterKey := make([]byte, keySize)
+	_, err = rand.Read(masterKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-		sharedSecret, err := getSharedSecret(ephemeralPrv, rpubkey)
+	env.Recipients = make([]*envelope.Recipient, 0)
+	for _, rpubkey := range pubkey {
+		r, err := newRecipient(f, env, masterKey, rpubkey, opts.Sender)
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, err
+		}
+		if g, ok := opts.Grants[r.PubKey]; ok {
+			r.Role, r.Identity = g.Role, g.Identity
+		}
+		r.Label = opts.Labels[r.PubKey]
+		if opts.Anonymous {
+			r.PubKey = ""
 		}
+		env.Recipients = append(env.Recipients, r)
+	}
+	env.Revocations = opts.Revocations
 
-		wrapKey, err := deriveWrapKey(sharedSecret, ephemeralPub, rpubkey)
-		if err != nil {
-			return nil, err
+	return f, env, masterKey, nil
+}
+
+// check key labels fit in a stanza, anonymous stanzas cannot have one
+func checkLabels(labels map[string]string, hide bool) error {
+	if hide && len(labels) > 0 {
+		return errors.New("anonymous envelopes cannot record key labels")
+	}
+	for _, l := range labels {
+		if len(l) > envelope.MaxLabelSize {
+			return fmt.Errorf("key label must be at most %d bytes", envelope.MaxLabelSize)
 		}
+	}
+	return nil
+}
 
-		rcptsKey, err := primitives.EncryptAEAD(wrapKey, masterKey)
-		if err != nil {
-			return nil, err
+// open data with private key
+func Open(envelope *envelope.Envelope, prvkey []byte, opts *Options) ([]byte, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	f, masterKey, _, err := unlock(envelope, prvkey, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.open(envelope, masterKey, opts.AD)
+}
+
+// open with private key and replace the stanza of recipient public key old
+// with one for public key new, the body is left untouched, the new stanza
+// keeps the role, identity, label and type of the old one, authcrypt stanzas
+// are sealed again with opts.Sender, which must be their sender private key
+func Rotate(env *envelope.Envelope, prvkey []byte, opts *Options, old, new []byte) (*envelope.Envelope, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if len(old) != keySize || len(new) != keySize {
+		return nil, fmt.Errorf("%w: public key must be %d bytes", ErrInvalidKey, keySize)
+	}
+
+	f, masterKey, r, err := unlock(env, prvkey, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// the stanza of old, anonymous stanzas are only known to their owner
+	idx := -1
+	for i, rcpt := range env.Recipients {
+		if rcpt.PubKey == b64.EncodeToString(new) {
+			return nil, fmt.Errorf("%w: public key is already a recipient", ErrInvalidKey)
+		}
+		if rcpt.PubKey == b64.EncodeToString(old) || (rcpt == r && r.PubKey == "" && ownKey(prvkey, old)) {
+			idx = i
 		}
+	}
+	if idx < 0 {
+		return nil, fmt.Errorf("%w: public key to rotate is not a recipient", ErrNoMatchingRecipient)
+	}
 
-		recipients = append(recipients, &envelope.Recipient{
-			PubKey:  b64.EncodeToString(rpubkey),
-			EPubKey: b64.EncodeToString(ephemeralPub),
-			DocKey:  rcptsKey,
-		})
+	out := unsignedCopy(env)
+
+	prev := out.Recipients[idx]
+	var sender []byte
+	if prev.Type == envelope.TypeAuthcrypt {
+		spk, err := b64.DecodeString(prev.Sender)
+		if err != nil || opts.Sender == nil || !ownKey(opts.Sender, spk) {
+			return nil, fmt.Errorf("%w: stanza is authcrypted, its sender private key is needed to rotate it", ErrInvalidKey)
+		}
+		sender = opts.Sender
+	}
+	rcpt, err := newRecipient(f, out, masterKey, new, sender)
+	if err != nil {
+		return nil, err
+	}
+	rcpt.Role, rcpt.Identity, rcpt.Label = prev.Role, prev.Identity, prev.Label
+	if prev.PubKey == "" {
+		rcpt.PubKey = ""
 	}
+	out.Recipients[idx] = rcpt
 
-	encBody, err := primitives.EncryptAEAD(masterKey, data)
+	out.MAC, err = f.header(out, masterKey)
 	if err != nil {
 		return nil, err
 	}
 
-	return envelope.NewEnvelope(envelope.V1, recipients, encBody), nil
+	return out, nil
 }
 
-// open data with private key
-func Open(envelope *envelope.Envelope, prvkey []byte) ([]byte, error) {
-	// pub derived from priv
-	pubkey, err := curve25519.X25519(prvkey, curve25519.Basepoint)
+// unwrap the master key of envelope with private key and verify the header
+// with it, returns the format of the envelope and the stanza the master key
+// was unwrapped from
+func unlock(envelope *envelope.Envelope, prvkey []byte, opts *Options) (*format, []byte, *envelope.Recipient, error) {
+	if len(prvkey) != keySize {
+		return nil, nil, nil, fmt.Errorf("%w: private key must be %d bytes", ErrInvalidKey, keySize)
+	}
+
+	f, err := lookup(envelope.Version)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := f.validate(envelope); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// stanzas of anonymous envelopes can only be found by trial decryption
+	trial := opts.TrialDecrypt || anonymous(envelope)
+
+	masterKey, r, err := unwrapMasterKey(f, envelope, prvkey, trial)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := verifyHeader(f, envelope, masterKey); err != nil {
+		return nil, nil, nil, err
+	}
+	if opts.ExpectSender != nil && !authcryptedBy(r, opts.ExpectSender) {
+		return nil, nil, nil, fmt.Errorf("%w: recipient stanza is not authenticated by the sender", ErrBodyAuthFailed)
+	}
+
+	return f, masterKey, r, nil
+}
+
+// copy of envelope sharing the body, with its own list of recipient stanzas
+// and without the signature, which no longer applies to the copy
+func unsignedCopy(env *envelope.Envelope) *envelope.Envelope {
+	out := *env
+	out.Signer, out.Signature = "", nil
+	out.Recipients = append([]*envelope.Recipient(nil), env.Recipients...)
+	return &out
+}
+
+// open with private key and update data
+func Update(envelope *envelope.Envelope, prvkey, data []byte, opts *Options) (*envelope.Envelope, error) {
+	// check if user can open
+	_, err := Open(envelope, prvkey, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, r := range envelope.Recipients {
-		rpubkey, err := b64.DecodeString(r.EPubKey)
-		if err != nil {
-			continue
+	rcptkeys, err := recipientKeys(envelope, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return Seal(data, resealOptions(envelope, opts), rcptkeys...)
+}
+
+// open with private key and append one or more recipients' public key, the
+// master key is wrapped for the new recipients only, the body and the
+// existing stanzas are left untouched, opts.AD is not used as the body is
+// not decrypted
+func Append(env *envelope.Envelope, prvkey []byte, opts *Options, pubkey ...[]byte) (*envelope.Envelope, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	for _, pubk := range pubkey {
+		if len(pubk) != keySize {
+			return nil, fmt.Errorf("%w: public key must be %d bytes", ErrInvalidKey, keySize)
 		}
+	}
+	if opts.Sender != nil && len(opts.Sender) != keySize {
+		return nil, fmt.Errorf("%w: sender private key must be %d bytes", ErrInvalidKey, keySize)
+	}
+
+	f, masterKey, _, err := unlock(env, prvkey, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	out := unsignedCopy(env)
 
-		sharedSecret, err := getSharedSecret(prvkey, rpubkey)
+	// known recipients, the caller's own stanza was found by unlock, keys of
+	// other anonymous stanzas only if given in options
+	own, err := curve25519.X25519(prvkey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	rcptkeys := append([][]byte{own}, opts.Recipients...)
+	for i, rcpt := range out.Recipients {
+		if rcpt.PubKey == "" {
+			continue
+		}
+		rpk, err := b64.DecodeString(rcpt.PubKey)
 		if err != nil {
-			return nil, err
+			return nil, malformed("recipient public key: %v", err)
 		}
+		rcptkeys = append(rcptkeys, rpk)
 
-		wrapKey, err := deriveWrapKey(sharedSecret, rpubkey, pubkey)
-		if err != nil {
-			return nil, err
+		// role changes of existing recipients only touch the stanza fields
+		if g, ok := opts.Grants[rcpt.PubKey]; ok && (g.Role != rcpt.Role || g.Identity != rcpt.Identity) {
+			r := *rcpt
+			r.Role, r.Identity = g.Role, g.Identity
+			out.Recipients[i] = &r
 		}
+	}
 
-		bodyKey, err := primitives.DecryptAEAD(wrapKey, r.DocKey)
-		if err != nil {
+	// append new recipients if not exists
+	hide := opts.Anonymous || anonymous(env)
+	if err := checkLabels(opts.Labels, hide); err != nil {
+		return nil, err
+	}
+	for _, pubk := range pubkey {
+		if contains(rcptkeys, pubk) {
 			continue
 		}
+		rcptkeys = append(rcptkeys, pubk)
 
-		decBody, err := primitives.DecryptAEAD(bodyKey, envelope.Body)
+		r, err := newRecipient(f, out, masterKey, pubk, opts.Sender)
 		if err != nil {
-			continue
+			return nil, err
+		}
+		if g, ok := opts.Grants[r.PubKey]; ok {
+			r.Role, r.Identity = g.Role, g.Identity
 		}
+		if hide {
+			r.PubKey = ""
+		} else {
+			r.Label = opts.Labels[r.PubKey]
+		}
+		out.Recipients = append(out.Recipients, r)
+	}
 
-		return decBody, nil
+	out.MAC, err = f.header(out, masterKey)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, nil
+	return out, nil
 }
 
-// open with private key and update data
-func Update(envelope *envelope.Envelope, prvkey []byte, data []byte) (*envelope.Envelope, error) {
-	// check if user can open
-	_, err := Open(envelope, prvkey)
+// open with private key and reseal under a new master key without one or
+// more recipients' public key
+func Remove(env *envelope.Envelope, prvkey []byte, opts *Options, pubkey ...[]byte) (*envelope.Envelope, error) {
+	data, err := Open(env, prvkey, opts)
+	if err != nil {
+		return nil, err
+	}
+	// recording the removed keys would reveal the hidden recipients
+	if opts != nil && len(opts.Revocations) > 0 && anonymous(env) {
+		return nil, errors.New("anonymous envelopes cannot record revocations")
+	}
+	if opts != nil && len(env.Revocations)+len(opts.Revocations) > envelope.MaxRevocations {
+		return nil, fmt.Errorf("envelope can record at most %d revocations", envelope.MaxRevocations)
+	}
+
+	rcptkeys, err := recipientKeys(env, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	// collect existing recipients keys
+	for _, pubk := range pubkey {
+		if !contains(rcptkeys, pubk) {
+			return nil, fmt.Errorf("%w: public key is not a recipient", ErrInvalidKey)
+		}
+	}
+
+	// keep recipients not removed
+	keep := make([][]byte, 0, len(rcptkeys))
+	for _, rpk := range rcptkeys {
+		if !contains(pubkey, rpk) {
+			keep = append(keep, rpk)
+		}
+	}
+	if len(keep) == 0 {
+		return nil, errors.New("cannot remove every recipient")
+	}
+
+	return Seal(data, resealOptions(env, opts), keep...)
+}
+
+// check if envelope has recipient stanzas and none of them reveal its
+// recipient public key
+func anonymous(env *envelope.Envelope) bool {
+	for _, r := range env.Recipients {
+		if r.PubKey != "" {
+			return false
+		}
+	}
+	return len(env.Recipients) > 0
+}
+
+// collect the recipients public keys of envelope, keys of anonymous stanzas
+// are taken from opts.Recipients
+func recipientKeys(env *envelope.Envelope, opts *Options) ([][]byte, error) {
 	rcptkeys := make([][]byte, 0)
-	for _, rcpt := range envelope.Recipients {
+	hidden := 0
+	for _, rcpt := range env.Recipients {
+		if rcpt.PubKey == "" {
+			hidden++
+			continue
+		}
 		rpk, err := b64.DecodeString(rcpt.PubKey)
 		if err != nil {
-			return nil, err
+			return nil, malformed("recipient public key: %v", err)
 		}
 		rcptkeys = append(rcptkeys, rpk)
 	}
+	if hidden == 0 {
+		return rcptkeys, nil
+	}
+
+	known := 0
+	if opts != nil {
+		for _, rpk := range opts.Recipients {
+			if !contains(rcptkeys, rpk) {
+				rcptkeys = append(rcptkeys, rpk)
+				known++
+			}
+		}
+	}
+	if known != hidden {
+		return nil, fmt.Errorf("envelope has %d anonymous recipients, %d public keys specified", hidden, known)
+	}
 
-	return Seal(data, rcptkeys...)
+	return rcptkeys, nil
 }
 
-// open with private key and append one or more recipients' public key
-func Append(envelope *envelope.Envelope, prvkey []byte, pubkey ...[]byte) (*envelope.Envelope, error) {
-	data, err := Open(envelope, prvkey)
+// options for sealing a modified copy of envelope, keeping its cipher suite
+// unless another one is requested, its recipient roles, labels and
+// revocations and keeping anonymous envelopes anonymous
+func resealOptions(env *envelope.Envelope, opts *Options) *Options {
+	o := &Options{Suite: env.Suite, Anonymous: anonymous(env), Grants: grants(env), Labels: labels(env)}
+	o.Revocations = append(o.Revocations, env.Revocations...)
+	if opts != nil {
+		o.AD = opts.AD
+		o.Revocations = append(o.Revocations, opts.Revocations...)
+		o.Anonymous = o.Anonymous || opts.Anonymous
+		for k, g := range opts.Grants {
+			o.Grants[k] = g
+		}
+		for k, l := range opts.Labels {
+			o.Labels[k] = l
+		}
+		if opts.Suite != "" {
+			o.Suite = opts.Suite
+		}
+	}
+	return o
+}
+
+// roles granted to the recipients of envelope
+func grants(env *envelope.Envelope) map[string]*Grant {
+	g := make(map[string]*Grant)
+	for _, r := range env.Recipients {
+		if r.Role != "" && r.PubKey != "" {
+			g[r.PubKey] = &Grant{Role: r.Role, Identity: r.Identity}
+		}
+	}
+	return g
+}
+
+// child key labels of the recipients of envelope
+func labels(env *envelope.Envelope) map[string]string {
+	l := make(map[string]string)
+	for _, r := range env.Recipients {
+		if r.Label != "" && r.PubKey != "" {
+			l[r.PubKey] = r.Label
+		}
+	}
+	return l
+}
+
+// create recipient stanza wrapping the master key for public key, the
+// stanza is authcrypted when sender private key is set
+func newRecipient(f *format, env *envelope.Envelope, masterKey, pubkey, sender []byte) (*envelope.Recipient, error) {
+	ephemeralPub, ephemeralPrv, err := GenerateKeys()
 	if err != nil {
 		return nil, err
 	}
 
-	// collect existing recipients keys
-	rcptkeys := make([][]byte, 0)
-	for _, rcpt := range envelope.Recipients {
-		rpk, err := b64.DecodeString(rcpt.PubKey)
+	sharedSecret, err := getSharedSecret(ephemeralPrv, pubkey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+
+	r := &envelope.Recipient{
+		PubKey:  b64.EncodeToString(pubkey),
+		EPubKey: b64.EncodeToString(ephemeralPub),
+	}
+
+	var wrapKey []byte
+	if sender == nil {
+		wrapKey, err = deriveWrapKey(sharedSecret, ephemeralPub, pubkey)
+	} else {
+		var senderPub []byte
+		senderPub, wrapKey, err = authcryptWrapKey(sharedSecret, sender, pubkey, ephemeralPub)
+		r.Type = envelope.TypeAuthcrypt
+		r.Sender = b64.EncodeToString(senderPub)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.wrap(env, wrapKey, masterKey, r); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// find the recipient stanza for private key and unwrap the master key,
+// stanzas are looked up by public key, stanzas without one are only tried
+// when trial is set
+func unwrapMasterKey(f *format, envelope *envelope.Envelope, prvkey []byte, trial bool) ([]byte, *envelope.Recipient, error) {
+	// pub derived from priv
+	pubkey, err := curve25519.X25519(prvkey, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	id := b64.EncodeToString(pubkey)
+
+	found := false
+	for _, r := range envelope.Recipients {
+		if r.PubKey != id {
+			continue
+		}
+		found = true
+
+		masterKey, err := unwrapRecipient(f, envelope, r, prvkey, pubkey)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		if masterKey != nil {
+			return masterKey, r, nil
 		}
-		rcptkeys = append(rcptkeys, rpk)
+	}
+	if found {
+		return nil, nil, fmt.Errorf("%w: recipient stanza has been tampered with", ErrBodyAuthFailed)
 	}
 
-	// append new recipients if not exists
-	for _, pubk := range pubkey {
-		if !contains(rcptkeys, pubk) {
-			rcptkeys = append(rcptkeys, pubk)
+	if trial {
+		for _, r := range envelope.Recipients {
+			if r.PubKey != "" {
+				continue
+			}
+
+			masterKey, err := unwrapRecipient(f, envelope, r, prvkey, pubkey)
+			if err != nil {
+				return nil, nil, err
+			}
+			if masterKey != nil {
+				return masterKey, r, nil
+			}
 		}
 	}
 
-	return Seal(data, rcptkeys...)
+	return nil, nil, ErrNoMatchingRecipient
+}
+
+// unwrap the master key from recipient stanza, returns nil if the stanza
+// does not decrypt with private key
+func unwrapRecipient(f *format, env *envelope.Envelope, r *envelope.Recipient, prvkey, pubkey []byte) ([]byte, error) {
+	epubkey, err := b64.DecodeString(r.EPubKey)
+	if err != nil {
+		return nil, malformed("ephemeral public key: %v", err)
+	}
+
+	sharedSecret, err := getSharedSecret(prvkey, epubkey)
+	if err != nil {
+		return nil, malformed("ephemeral public key: %v", err)
+	}
+
+	var wrapKey []byte
+	if r.Type == envelope.TypeAuthcrypt {
+		wrapKey, err = authcryptUnwrapKey(sharedSecret, prvkey, pubkey, epubkey, r)
+	} else {
+		wrapKey, err = deriveWrapKey(sharedSecret, epubkey, pubkey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	masterKey, err := f.unwrap(env, wrapKey, r)
+	if err != nil {
+		return nil, nil
+	}
+
+	return masterKey, nil
+}
+
+// MAC over the authenticated envelope header, keyed from the master key
+func headerMAC(env *envelope.Envelope, masterKey []byte) ([]byte, error) {
+	header, err := env.AuthenticatedHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	macKey, err := deriveKey(masterKey, headerKeyInfo+env.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hmac.New(sha256.New, macKey)
+	h.Write(header)
+	return h.Sum(nil), nil
 }
 
 func getSharedSecret(prvkey, pubkey []byte) ([]byte, error) {
@@ -191,6 +682,26 @@ func deriveWrapKey(sharedSecret, ephemeralPub, pubkey []byte) ([]byte, error) {
 	return key, nil
 }
 
+func deriveKey(masterKey []byte, info string) ([]byte, error) {
+	h := hkdf.New(sha256.New, masterKey, nil, []byte(info))
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func malformed(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", envelope.ErrMalformedEnvelope, fmt.Sprintf(format, args...))
+}
+
+// check if public key belongs to private key
+func ownKey(prvkey, pubkey []byte) bool {
+	pub, err := curve25519.X25519(prvkey, curve25519.Basepoint)
+	return err == nil && hmac.Equal(pub, pubkey)
+}
+
 func contains(in [][]byte, a []byte) bool {
 	for _, b := range in {
 		if bytes.Compare(a, b) == 0 {
@@ -0,0 +1,198 @@
+package pubkit
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted private key format:
+//
+//	magic    "PUBKITKEY"
+//	version  1 byte, currently 1
+//	kdf      1 byte, 1 for scrypt
+//	logN     1 byte, scrypt cost as a power of two
+//	r        1 byte, scrypt block size
+//	p        1 byte, scrypt parallelization
+//	salt     16 bytes
+//	nonce    24 bytes
+//	key      private key encrypted with XChaCha20-Poly1305, 48 bytes
+//
+// The key is encrypted under the scrypt hash of the passphrase, with the
+// bytes preceding the nonce as associated data so the parameters cannot be
+// changed.
+
+const (
+	keyFileMagic   = "PUBKITKEY"
+	keyFileVersion = 1
+	kdfScrypt      = 1
+	keyFileSalt    = 16
+	keyFileHeader  = len(keyFileMagic) + 5 + keyFileSalt
+	keyFileSize    = keyFileHeader + chacha20poly1305.NonceSizeX + 32 + 16
+)
+
+// limits on scrypt parameters, so opening a key file cannot exhaust memory
+const (
+	minLogN = 10
+	maxLogN = 22
+	maxR    = 32
+	maxP    = 16
+)
+
+// scrypt parameters of encrypted private keys
+type KeyParams struct {
+	// CPU and memory cost as a power of two
+	LogN int
+	// block size
+	R int
+	// parallelization
+	P int
+}
+
+// parameters used by EncryptPrivateKey, about a second and 256 MiB
+var DefaultKeyParams = KeyParams{LogN: 18, R: 8, P: 1}
+
+// encrypt private key with passphrase
+func EncryptPrivateKey(prvkey, passphrase []byte) ([]byte, error) {
+	return EncryptPrivateKeyWithParams(prvkey, passphrase, &DefaultKeyParams)
+}
+
+// encrypt private key with passphrase and scrypt parameters
+func EncryptPrivateKeyWithParams(prvkey, passphrase []byte, params *KeyParams) ([]byte, error) {
+	if len(prvkey) != 32 {
+		return nil, fmt.Errorf("%w: private key must be 32 bytes", ErrInvalidKey)
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase must be specified")
+	}
+	if params == nil {
+		params = &DefaultKeyParams
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, keyFileHeader, keyFileSize)
+	copy(b, keyFileMagic)
+	h := b[len(keyFileMagic):]
+	h[0], h[1] = keyFileVersion, kdfScrypt
+	h[2], h[3], h[4] = byte(params.LogN), byte(params.R), byte(params.P)
+	if _, err := rand.Read(h[5:]); err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	aead, err := keyFileCipher(passphrase, h[5:], params)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, nonce...)
+	return aead.Seal(b, nonce, prvkey, b[:keyFileHeader]), nil
+}
+
+// decrypt private key encrypted with passphrase
+func DecryptPrivateKey(data, passphrase []byte) ([]byte, error) {
+	params, err := KeyFileParams(data)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := data[keyFileHeader-keyFileSalt : keyFileHeader]
+	nonce := data[keyFileHeader : keyFileHeader+chacha20poly1305.NonceSizeX]
+	aead, err := keyFileCipher(passphrase, salt, params)
+	if err != nil {
+		return nil, err
+	}
+
+	prvkey, err := aead.Open(nil, nonce, data[keyFileHeader+len(nonce):], data[:keyFileHeader])
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return prvkey, nil
+}
+
+// scrypt parameters of encrypted private key
+func KeyFileParams(data []byte) (*KeyParams, error) {
+	if len(data) != keyFileSize || !bytes.HasPrefix(data, []byte(keyFileMagic)) {
+		return nil, fmt.Errorf("%w: not an encrypted private key", ErrInvalidKey)
+	}
+	h := data[len(keyFileMagic):]
+	if h[0] != keyFileVersion {
+		return nil, fmt.Errorf("%w: key file version %d", ErrUnsupportedVersion, h[0])
+	}
+	if h[1] != kdfScrypt {
+		return nil, fmt.Errorf("%w: key file kdf %d", ErrUnsupportedVersion, h[1])
+	}
+
+	params := &KeyParams{LogN: int(h[2]), R: int(h[3]), P: int(h[4])}
+	if err := params.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	return params, nil
+}
+
+// re-encrypt private key if it is encrypted with weaker parameters than
+// params, each parameter is raised to params but never lowered, reports
+// whether the key was re-encrypted
+func UpgradePrivateKey(data, passphrase []byte, params *KeyParams) ([]byte, bool, error) {
+	if params == nil {
+		params = &DefaultKeyParams
+	}
+
+	prvkey, err := DecryptPrivateKey(data, passphrase)
+	if err != nil {
+		return nil, false, err
+	}
+	current, err := KeyFileParams(data)
+	if err != nil {
+		return nil, false, err
+	}
+	if current.LogN >= params.LogN && current.R >= params.R && current.P >= params.P {
+		return data, false, nil
+	}
+
+	upgraded := &KeyParams{
+		LogN: maxInt(current.LogN, params.LogN),
+		R:    maxInt(current.R, params.R),
+		P:    maxInt(current.P, params.P),
+	}
+	data, err = EncryptPrivateKeyWithParams(prvkey, passphrase, upgraded)
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (p *KeyParams) validate() error {
+	if p.LogN < minLogN || p.LogN > maxLogN {
+		return fmt.Errorf("scrypt cost must be between 2^%d and 2^%d", minLogN, maxLogN)
+	}
+	if p.R < 1 || p.R > maxR || p.P < 1 || p.P > maxP {
+		return fmt.Errorf("scrypt r must be between 1 and %d, p between 1 and %d", maxR, maxP)
+	}
+	return nil
+}
+
+func keyFileCipher(passphrase, salt []byte, params *KeyParams) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<params.LogN, params.R, params.P, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(key)
+}
@@ -0,0 +1,237 @@
+package pubkit
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+
+	"github.com/speier/pubkit/internal/bech32"
+	"github.com/speier/pubkit/pkg/envelope"
+)
+
+// Keys are written as Bech32 strings, public keys with the prefix
+// "pubkit1" in lowercase and private keys with "PUBKIT-SECRET-KEY-1" in
+// uppercase. The checksum catches typos and the prefix catches a key of
+// the wrong type.
+
+// Bech32 human-readable parts of key strings
+const (
+	publicKeyHRP  = "pubkit"
+	privateKeyHRP = "pubkit-secret-key-"
+)
+
+// encode public key as a key string
+func EncodePublicKey(pubkey []byte) (string, error) {
+	if len(pubkey) != 32 {
+		return "", fmt.Errorf("%w: public key must be 32 bytes", ErrInvalidKey)
+	}
+	return bech32.Encode(publicKeyHRP, pubkey)
+}
+
+// encode private key as a key string
+func EncodePrivateKey(prvkey []byte) (string, error) {
+	if len(prvkey) != 32 {
+		return "", fmt.Errorf("%w: private key must be 32 bytes", ErrInvalidKey)
+	}
+	s, err := bech32.Encode(privateKeyHRP, prvkey)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToUpper(s), nil
+}
+
+// parse public key string, private key strings are rejected
+func ParsePublicKey(s string) ([]byte, error) {
+	return parseKey(s, publicKeyHRP, "public")
+}
+
+// parse private key string, public key strings are rejected
+func ParsePrivateKey(s string) ([]byte, error) {
+	return parseKey(s, privateKeyHRP, "private")
+}
+
+func parseKey(s, hrp, kind string) ([]byte, error) {
+	prefix, key, err := bech32.Decode(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	if prefix != hrp {
+		switch prefix {
+		case publicKeyHRP:
+			return nil, fmt.Errorf("%w: got a public key, expected a %s key", ErrInvalidKey, kind)
+		case privateKeyHRP:
+			return nil, fmt.Errorf("%w: got a private key, expected a %s key", ErrInvalidKey, kind)
+		}
+		return nil, fmt.Errorf("%w: unknown key prefix %q", ErrInvalidKey, prefix)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%w: %s key must be 32 bytes", ErrInvalidKey, kind)
+	}
+	return key, nil
+}
+
+// X25519 public key
+type PublicKey struct {
+	key [32]byte
+}
+
+// X25519 private key, formatting it never reveals the key
+type PrivateKey struct {
+	key [32]byte
+	pub PublicKey
+}
+
+// public key from its 32 bytes, low-order points are rejected
+func NewPublicKey(b []byte) (*PublicKey, error) {
+	if len(b) != 32 {
+		return nil, fmt.Errorf("%w: public key must be 32 bytes", ErrInvalidKey)
+	}
+	// a low-order point yields the all-zero shared secret with any scalar
+	if _, err := curve25519.X25519(lowOrderScalar, b); err != nil {
+		return nil, fmt.Errorf("%w: public key is a low-order point", ErrInvalidKey)
+	}
+
+	k := &PublicKey{}
+	copy(k.key[:], b)
+	return k, nil
+}
+
+// private key from its 32 bytes
+func NewPrivateKey(b []byte) (*PrivateKey, error) {
+	if len(b) != 32 {
+		return nil, fmt.Errorf("%w: private key must be 32 bytes", ErrInvalidKey)
+	}
+	if subtle.ConstantTimeCompare(b, make([]byte, 32)) == 1 {
+		return nil, fmt.Errorf("%w: private key is all zero", ErrInvalidKey)
+	}
+
+	pub, err := curve25519.X25519(b, curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+
+	k := &PrivateKey{}
+	copy(k.key[:], b)
+	copy(k.pub.key[:], pub)
+	return k, nil
+}
+
+// generate new private key
+func GeneratePrivateKey() (*PrivateKey, error) {
+	_, prv, err := GenerateKeys()
+	if err != nil {
+		return nil, err
+	}
+	return NewPrivateKey(prv)
+}
+
+// bytes of public key
+func (k *PublicKey) Bytes() []byte {
+	return append([]byte(nil), k.key[:]...)
+}
+
+// check if both public keys are the same
+func (k *PublicKey) Equal(other *PublicKey) bool {
+	return other != nil && k.key == other.key
+}
+
+// public key string
+func (k PublicKey) String() string {
+	s, _ := EncodePublicKey(k.key[:])
+	return s
+}
+
+// encode public key as key string
+func (k *PublicKey) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// decode public key from key string
+func (k *PublicKey) UnmarshalText(text []byte) error {
+	b, err := ParsePublicKey(string(text))
+	if err != nil {
+		return err
+	}
+	pub, err := NewPublicKey(b)
+	if err != nil {
+		return err
+	}
+	*k = *pub
+	return nil
+}
+
+// public key of private key
+func (k *PrivateKey) Public() *PublicKey {
+	pub := k.pub
+	return &pub
+}
+
+// bytes of private key, keep them secret
+func (k *PrivateKey) Bytes() []byte {
+	return append([]byte(nil), k.key[:]...)
+}
+
+// check if both private keys are the same, in constant time
+func (k *PrivateKey) Equal(other *PrivateKey) bool {
+	return other != nil && subtle.ConstantTimeCompare(k.key[:], other.key[:]) == 1
+}
+
+// identifies private key by its public key
+func (k PrivateKey) String() string {
+	return "PrivateKey(" + k.pub.String() + ")"
+}
+
+// formats private key with String for every verb, so the key cannot be
+// printed by accident
+func (k PrivateKey) Format(f fmt.State, verb rune) {
+	io.WriteString(f, k.String())
+}
+
+// seal data for recipients
+func SealFor(data []byte, recipients ...*PublicKey) (*envelope.Envelope, error) {
+	pubkeys, err := publicKeyBytes(recipients)
+	if err != nil {
+		return nil, err
+	}
+	return Seal(data, pubkeys...)
+}
+
+// seal data for recipients with options
+func SealForWithOptions(data []byte, opts *SealOptions, recipients ...*PublicKey) (*envelope.Envelope, error) {
+	pubkeys, err := publicKeyBytes(recipients)
+	if err != nil {
+		return nil, err
+	}
+	return SealWithOptions(data, opts, pubkeys...)
+}
+
+// open data with private key
+func OpenWithKey(envelope *envelope.Envelope, key *PrivateKey) ([]byte, error) {
+	return OpenWithKeyAndOptions(envelope, key, nil)
+}
+
+// open data with private key and options
+func OpenWithKeyAndOptions(envelope *envelope.Envelope, key *PrivateKey, opts *OpenOptions) ([]byte, error) {
+	if key == nil {
+		return nil, fmt.Errorf("%w: private key must be specified", ErrInvalidKey)
+	}
+	return OpenWithOptions(envelope, key.key[:], opts)
+}
+
+func publicKeyBytes(keys []*PublicKey) ([][]byte, error) {
+	pubkeys := make([][]byte, 0, len(keys))
+	for _, k := range keys {
+		if k == nil {
+			return nil, fmt.Errorf("%w: public key is nil", ErrInvalidKey)
+		}
+		pubkeys = append(pubkeys, k.key[:])
+	}
+	return pubkeys, nil
+}
+
+// clamped scalar used to detect low-order points
+var lowOrderScalar = bytes.Repeat([]byte{0x42}, 32)
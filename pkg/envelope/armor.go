@@ -0,0 +1,148 @@
+package envelope
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ASCII armored text format:
+//
+//	-----BEGIN PUBKIT ENVELOPE-----
+//	Version: 1.0
+//	Comment: optional header fields
+//
+//	<binary envelope, base64 wrapped at 64 columns>
+//	=<CRC-24 of the binary envelope, base64>
+//	-----END PUBKIT ENVELOPE-----
+//
+// Lines may be indented or end with CRLF, surrounding whitespace is ignored.
+
+const (
+	armorBegin   = "-----BEGIN PUBKIT ENVELOPE-----"
+	armorEnd     = "-----END PUBKIT ENVELOPE-----"
+	armorColumns = 64
+	armorVersion = "Version"
+)
+
+// encode envelope as ASCII armored text with optional header fields
+func Armor(e *Envelope, headers map[string]string) ([]byte, error) {
+	data, err := e.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(headers))
+	for k, v := range headers {
+		if k == armorVersion {
+			return nil, errors.New("version header is set from the envelope")
+		}
+		if k == "" || strings.ContainsAny(k, ":\r\n") || strings.TrimSpace(k) != k {
+			return nil, fmt.Errorf("invalid armor header name %q", k)
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, fmt.Errorf("invalid armor header value for %q", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.WriteString(armorBegin + "\n")
+	fmt.Fprintf(&buf, "%s: %s\n", armorVersion, e.Version)
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s: %s\n", k, headers[k])
+	}
+	buf.WriteString("\n")
+
+	body := dataEncoding.EncodeToString(data)
+	for len(body) > armorColumns {
+		buf.WriteString(body[:armorColumns] + "\n")
+		body = body[armorColumns:]
+	}
+	if len(body) > 0 {
+		buf.WriteString(body + "\n")
+	}
+
+	crc := crc24(data)
+	buf.WriteString("=" + dataEncoding.EncodeToString([]byte{byte(crc >> 16), byte(crc >> 8), byte(crc)}) + "\n")
+	buf.WriteString(armorEnd + "\n")
+
+	return buf.Bytes(), nil
+}
+
+// decode ASCII armored envelope, returns the envelope and its header fields
+func Dearmor(data []byte) (*Envelope, map[string]string, error) {
+	text := strings.Replace(string(data), "\r\n", "\n", -1)
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+
+	if len(lines) < 3 || lines[0] != armorBegin || lines[len(lines)-1] != armorEnd {
+		return nil, nil, malformed("missing armor begin or end line")
+	}
+	lines = lines[1 : len(lines)-1]
+
+	// header fields, terminated by an empty line
+	headers := make(map[string]string)
+	for len(lines) > 0 && strings.Contains(lines[0], ":") {
+		kv := strings.SplitN(lines[0], ":", 2)
+		k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if _, ok := headers[k]; ok || k == "" {
+			return nil, nil, malformed("invalid armor header %q", lines[0])
+		}
+		headers[k] = v
+		lines = lines[1:]
+	}
+	if len(headers) > 0 {
+		if len(lines) == 0 || lines[0] != "" {
+			return nil, nil, malformed("missing empty line after armor headers")
+		}
+		lines = lines[1:]
+	}
+
+	// base64 body followed by the checksum line
+	if len(lines) == 0 || !strings.HasPrefix(lines[len(lines)-1], "=") {
+		return nil, nil, malformed("missing armor checksum")
+	}
+	sum, err := dataEncoding.DecodeString(lines[len(lines)-1][1:])
+	if err != nil || len(sum) != 3 {
+		return nil, nil, malformed("invalid armor checksum")
+	}
+
+	raw, err := dataEncoding.DecodeString(strings.Join(lines[:len(lines)-1], ""))
+	if err != nil {
+		return nil, nil, malformed("armor body: %v", err)
+	}
+	if crc := crc24(raw); sum[0] != byte(crc>>16) || sum[1] != byte(crc>>8) || sum[2] != byte(crc) {
+		return nil, nil, malformed("armor checksum mismatch")
+	}
+
+	e := &Envelope{}
+	if err := e.UnmarshalBinary(raw); err != nil {
+		return nil, nil, err
+	}
+	if v, ok := headers[armorVersion]; ok && v != e.Version {
+		return nil, nil, malformed("armor version %q does not match envelope version %q", v, e.Version)
+	}
+
+	return e, headers, nil
+}
+
+// CRC-24 as defined in RFC 4880
+func crc24(data []byte) uint32 {
+	crc := uint32(0xb704ce)
+	for _, b := range data {
+		crc ^= uint32(b) << 16
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= 0x1864cfb
+			}
+		}
+	}
+	return crc & 0xffffff
+}
@@ -0,0 +1,412 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Binary wire format, all integers are big-endian:
+//
+//	magic       "PUBKIT"
+//	format      1 byte, currently 1
+//	fields      1 byte count, followed by that many tagged fields
+//	recipients  2 byte count, each one a 1 byte count followed by tagged fields
+//	body        all remaining bytes
+//
+// A tagged field is a 1 byte tag, a 2 byte length and a non-empty value.
+// Fields are written in strictly increasing tag order and empty fields are
+// omitted, so an envelope has exactly one valid encoding. Unknown tags are
+// rejected when decoding.
+//
+// Envelope fields:
+//
+//	1  Version
+//	2  MAC
+//	3  Nonce
+//	4  Suite
+//	5  Signer
+//	6  Signature
+//	7  Revocations
+//
+// Revocations are encoded as a single field, a sequence of entries of an
+// 8 byte Unix time, a 1 byte length and the public key.
+//
+// Recipient fields:
+//
+//	1  PubKey
+//	2  EPubKey
+//	3  DocKey
+//	4  Nonce
+//	5  Type
+//	6  Sender
+//	7  Role
+//	8  Identity
+//	9  Label
+
+const (
+	// maximum number of recipient stanzas in an encoded envelope
+	MaxRecipients = 4096
+	// maximum number of revocations in an encoded envelope, they share a
+	// single field
+	MaxRevocations = 1024
+	// maximum size of a recipient label in bytes
+	MaxLabelSize = 255
+	// maximum body size accepted when decoding an envelope, 1 GiB, streamed
+	// envelopes with a larger body are only read by the pubkit stream readers
+	MaxBodySize = 1 << 30
+)
+
+const (
+	binaryMagic  = "PUBKIT"
+	binaryFormat = 1
+	maxFieldSize = 1<<16 - 1
+)
+
+// envelope field tags
+const (
+	tagVersion     = 1
+	tagMAC         = 2
+	tagNonce       = 3
+	tagSuite       = 4
+	tagSigner      = 5
+	tagSignature   = 6
+	tagRevocations = 7
+)
+
+// recipient field tags
+const (
+	tagPubKey   = 1
+	tagEPubKey  = 2
+	tagDocKey   = 3
+	tagRNonce   = 4
+	tagType     = 5
+	tagSender   = 6
+	tagRole     = 7
+	tagIdentity = 8
+	tagLabel    = 9
+)
+
+type field struct {
+	tag   byte
+	value []byte
+}
+
+// encode envelope in binary wire format
+func (e *Envelope) MarshalBinary() ([]byte, error) {
+	if len(e.Body) > MaxBodySize {
+		return nil, errors.New("envelope body too large")
+	}
+
+	b, err := e.appendHeader(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, e.Body...), nil
+}
+
+// decode envelope from binary wire format
+func (e *Envelope) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	env, err := readHeader(r)
+	if err != nil {
+		return err
+	}
+	if r.Len() > MaxBodySize {
+		return malformed("body too large")
+	}
+
+	env.Body = append([]byte(nil), data[len(data)-r.Len():]...)
+	*e = *env
+
+	return nil
+}
+
+func (e *Envelope) fields() ([]field, error) {
+	revocations, err := encodeRevocations(e.Revocations)
+	if err != nil {
+		return nil, err
+	}
+
+	return []field{
+		{tagVersion, []byte(e.Version)},
+		{tagMAC, e.MAC},
+		{tagNonce, e.Nonce},
+		{tagSuite, []byte(e.Suite)},
+		{tagSigner, []byte(e.Signer)},
+		{tagSignature, e.Signature},
+		{tagRevocations, revocations},
+	}, nil
+}
+
+func (r *Recipient) fields() []field {
+	return []field{
+		{tagPubKey, []byte(r.PubKey)},
+		{tagEPubKey, []byte(r.EPubKey)},
+		{tagDocKey, r.DocKey},
+		{tagRNonce, r.Nonce},
+		{tagType, []byte(r.Type)},
+		{tagSender, []byte(r.Sender)},
+		{tagRole, []byte(r.Role)},
+		{tagIdentity, []byte(r.Identity)},
+		{tagLabel, []byte(r.Label)},
+	}
+}
+
+func (e *Envelope) appendHeader(b []byte) ([]byte, error) {
+	if len(e.Recipients) > MaxRecipients {
+		return nil, errors.New("too many recipients")
+	}
+
+	b = append(b, binaryMagic...)
+	b = append(b, binaryFormat)
+
+	fields, err := e.fields()
+	if err != nil {
+		return nil, err
+	}
+	b, err = appendFields(b, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	b = append(b, byte(len(e.Recipients)>>8), byte(len(e.Recipients)))
+	for _, r := range e.Recipients {
+		if r == nil {
+			return nil, malformed("recipient is nil")
+		}
+		b, err = appendFields(b, r.fields())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+func appendFields(b []byte, fields []field) ([]byte, error) {
+	n := 0
+	for _, f := range fields {
+		if len(f.value) > maxFieldSize {
+			return nil, fmt.Errorf("field %d too long", f.tag)
+		}
+		if len(f.value) > 0 {
+			n++
+		}
+	}
+
+	b = append(b, byte(n))
+	for _, f := range fields {
+		if len(f.value) == 0 {
+			continue
+		}
+		b = append(b, f.tag, byte(len(f.value)>>8), byte(len(f.value)))
+		b = append(b, f.value...)
+	}
+
+	return b, nil
+}
+
+// decode envelope header from binary wire format, r is left at the start of
+// the body, which is not read
+func ReadHeader(r io.Reader) (*Envelope, error) {
+	return readHeader(r)
+}
+
+func readHeader(r io.Reader) (*Envelope, error) {
+	prefix, err := readBytes(r, len(binaryMagic)+1)
+	if err != nil {
+		return nil, err
+	}
+	if string(prefix[:len(binaryMagic)]) != binaryMagic {
+		return nil, malformed("bad magic")
+	}
+	if prefix[len(binaryMagic)] != binaryFormat {
+		return nil, malformed("unknown format %d", prefix[len(binaryMagic)])
+	}
+
+	fields, err := readFields(r)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Envelope{}
+	for _, f := range fields {
+		switch f.tag {
+		case tagVersion:
+			e.Version = string(f.value)
+		case tagMAC:
+			e.MAC = f.value
+		case tagNonce:
+			e.Nonce = f.value
+		case tagSuite:
+			e.Suite = string(f.value)
+		case tagSigner:
+			e.Signer = string(f.value)
+		case tagSignature:
+			e.Signature = f.value
+		case tagRevocations:
+			e.Revocations, err = decodeRevocations(f.value)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, malformed("unknown envelope field %d", f.tag)
+		}
+	}
+	if e.Version == "" {
+		return nil, malformed("missing version")
+	}
+	if !Supported(e.Version) {
+		return nil, &UnsupportedVersionError{Version: e.Version}
+	}
+
+	count, err := readBytes(r, 2)
+	if err != nil {
+		return nil, err
+	}
+	n := int(count[0])<<8 | int(count[1])
+	if n > MaxRecipients {
+		return nil, malformed("too many recipients")
+	}
+
+	e.Recipients = make([]*Recipient, 0, n)
+	for i := 0; i < n; i++ {
+		rcpt, err := readRecipient(r)
+		if err != nil {
+			return nil, err
+		}
+		e.Recipients = append(e.Recipients, rcpt)
+	}
+
+	return e, nil
+}
+
+func encodeRevocations(revocations []*Revocation) ([]byte, error) {
+	if len(revocations) > MaxRevocations {
+		return nil, errors.New("too many revocations")
+	}
+
+	var b []byte
+	for _, rev := range revocations {
+		if rev == nil {
+			return nil, errors.New("revocation is nil")
+		}
+		if rev.PubKey == "" || len(rev.PubKey) > 255 {
+			return nil, errors.New("invalid revocation public key")
+		}
+		var t [8]byte
+		binary.BigEndian.PutUint64(t[:], uint64(rev.Time.Unix()))
+		b = append(b, t[:]...)
+		b = append(b, byte(len(rev.PubKey)))
+		b = append(b, rev.PubKey...)
+	}
+	return b, nil
+}
+
+func decodeRevocations(b []byte) ([]*Revocation, error) {
+	var revocations []*Revocation
+	for len(b) > 0 {
+		if len(b) < 9 || len(b) < 9+int(b[8]) || b[8] == 0 {
+			return nil, malformed("invalid revocation")
+		}
+		n := 9 + int(b[8])
+		revocations = append(revocations, &Revocation{
+			PubKey: string(b[9:n]),
+			Time:   time.Unix(int64(binary.BigEndian.Uint64(b)), 0).UTC(),
+		})
+		b = b[n:]
+	}
+	if len(revocations) > MaxRevocations {
+		return nil, malformed("too many revocations")
+	}
+	return revocations, nil
+}
+
+func readRecipient(r io.Reader) (*Recipient, error) {
+	fields, err := readFields(r)
+	if err != nil {
+		return nil, err
+	}
+
+	rcpt := &Recipient{}
+	for _, f := range fields {
+		switch f.tag {
+		case tagPubKey:
+			rcpt.PubKey = string(f.value)
+		case tagEPubKey:
+			rcpt.EPubKey = string(f.value)
+		case tagDocKey:
+			rcpt.DocKey = f.value
+		case tagRNonce:
+			rcpt.Nonce = f.value
+		case tagType:
+			rcpt.Type = string(f.value)
+		case tagSender:
+			rcpt.Sender = string(f.value)
+		case tagRole:
+			rcpt.Role = string(f.value)
+		case tagIdentity:
+			rcpt.Identity = string(f.value)
+		case tagLabel:
+			rcpt.Label = string(f.value)
+		default:
+			return nil, malformed("unknown recipient field %d", f.tag)
+		}
+	}
+	if rcpt.EPubKey == "" || len(rcpt.DocKey) == 0 {
+		return nil, malformed("incomplete recipient")
+	}
+
+	return rcpt, nil
+}
+
+func readFields(r io.Reader) ([]field, error) {
+	count, err := readBytes(r, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make([]field, 0, count[0])
+	for i := 0; i < int(count[0]); i++ {
+		hdr, err := readBytes(r, 3)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) > 0 && hdr[0] <= fields[len(fields)-1].tag {
+			return nil, malformed("fields out of order")
+		}
+
+		size := int(hdr[1])<<8 | int(hdr[2])
+		if size == 0 {
+			return nil, malformed("empty field %d", hdr[0])
+		}
+		value, err := readBytes(r, size)
+		if err != nil {
+			return nil, err
+		}
+
+		fields = append(fields, field{hdr[0], value})
+	}
+
+	return fields, nil
+}
+
+func readBytes(r io.Reader, n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, malformed("truncated")
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+func malformed(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrMalformedEnvelope, fmt.Sprintf(format, args...))
+}
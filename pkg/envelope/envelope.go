@@ -1,19 +1,78 @@
 package envelope
 
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
 const (
 	V1 = "1.0"
+	// header authenticated with a MAC keyed from the master key
+	V2 = "2.0"
+	// XChaCha20-Poly1305 with random nonces stored in the envelope
+	V3 = "3.0"
+	// body encrypted in chunks, so it can be streamed
+	V4 = "4.0"
+)
+
+// recipient stanza types, stanzas without type are X25519 stanzas
+const (
+	// key agreement with the ephemeral and the static sender key
+	TypeAuthcrypt = "authcrypt"
+)
+
+// recipient roles, writers and admins are identified by an Ed25519 key
+const (
+	// can open the envelope
+	RoleReader = "reader"
+	// can open and update the envelope
+	RoleWriter = "writer"
+	// can open, update and change the recipients of the envelope
+	RoleAdmin = "admin"
+)
+
+// versions known to this package, the only list of versions, every
+// version has a format in internal/x25519
+var versions = []string{V1, V2, V3, V4}
+
+var (
+	// envelope is structurally invalid
+	ErrMalformedEnvelope = errors.New("malformed envelope")
+	// envelope version or algorithm is not supported
+	ErrUnsupportedVersion = errors.New("unsupported envelope version")
 )
 
 type Recipient struct {
-	PubKey  string
-	EPubKey string
-	DocKey  []byte
+	PubKey   string
+	EPubKey  string
+	Type     string
+	Sender   string
+	Role     string
+	Identity string
+	Label    string
+	Nonce    []byte
+	DocKey   []byte
+}
+
+// record of a recipient removed from the envelope
+type Revocation struct {
+	// public key of the removed recipient
+	PubKey string
+	// time of the removal, stored with second precision
+	Time time.Time
 }
 
 type Envelope struct {
-	Version    string
-	Recipients []*Recipient
-	Body       []byte
+	Version     string
+	Suite       string
+	Recipients  []*Recipient
+	MAC         []byte
+	Nonce       []byte
+	Signer      string
+	Signature   []byte
+	Revocations []*Revocation
+	Body        []byte
 }
 
 func NewEnvelope(version string, recipients []*Recipient, body []byte) *Envelope {
@@ -23,3 +82,49 @@ func NewEnvelope(version string, recipients []*Recipient, body []byte) *Envelope
 		Body:       body,
 	}
 }
+
+// error returned for envelope versions that cannot be decoded
+type UnsupportedVersionError struct {
+	Version string
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("%v %q", ErrUnsupportedVersion, e.Version)
+}
+
+func (e *UnsupportedVersionError) Unwrap() error {
+	return ErrUnsupportedVersion
+}
+
+// known envelope versions, oldest first
+func Versions() []string {
+	return append([]string(nil), versions...)
+}
+
+// check if envelope version is known
+func Supported(version string) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// canonical encoding of the envelope header covered by the header MAC,
+// that is the binary encoding without the MAC, signer, signature and body
+func (e *Envelope) AuthenticatedHeader() ([]byte, error) {
+	h := *e
+	h.MAC = nil
+	h.Signer = ""
+	h.Signature = nil
+	return h.appendHeader(nil)
+}
+
+// data covered by the envelope signature, that is the binary encoding
+// without the signature
+func (e *Envelope) SignedData() ([]byte, error) {
+	s := *e
+	s.Signature = nil
+	return s.MarshalBinary()
+}
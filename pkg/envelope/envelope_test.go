@@ -0,0 +1,217 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEnvelope() *Envelope {
+	e := NewEnvelope(V1, []*Recipient{
+		{PubKey: "a-pub", EPubKey: "a-epub", DocKey: []byte("a-dockey")},
+		{PubKey: "b-pub", EPubKey: "b-epub", Label: "laptop", DocKey: []byte("b-dockey")},
+	}, []byte("body"))
+	e.Revocations = []*Revocation{{PubKey: "Yy1wdWI", Time: time.Unix(1600000000, 0).UTC()}}
+	return e
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	want := testEnvelope()
+
+	data, err := want.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := &Envelope{}
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestBinaryStrict(t *testing.T) {
+	data, err := testEnvelope().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every truncation inside the header must fail
+	hdr, _ := testEnvelope().appendHeader(nil)
+	for i := 0; i < len(hdr); i++ {
+		if err := new(Envelope).UnmarshalBinary(data[:i]); err == nil {
+			t.Errorf("truncated at %d: expected error", i)
+		}
+	}
+
+	// unknown version
+	env := testEnvelope()
+	env.Version = "9.9"
+	bad, _ := env.MarshalBinary()
+	if err := new(Envelope).UnmarshalBinary(bad); err == nil {
+		t.Error("unknown version: expected error")
+	}
+
+	// unknown recipient field
+	bad = bytes.Replace(data, []byte{tagDocKey, 0, 8}, []byte{9, 0, 8}, 1)
+	if err := new(Envelope).UnmarshalBinary(bad); err == nil {
+		t.Error("unknown field: expected error")
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	want := testEnvelope()
+	want.Recipients[0].PubKey = "YS1wdWI"
+	want.Recipients[0].EPubKey = "YS1lcHVi"
+	want.Recipients[1].PubKey = ""
+	want.Recipients[1].EPubKey = "Yi1lcHVi"
+
+	data, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := &Envelope{}
+	if err := json.Unmarshal(data, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestJSONByValue(t *testing.T) {
+	env := testEnvelope()
+	want, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// values that are not addressable use the same encoding
+	got, err := json.Marshal(*env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("by value: got %s, want %s", got, want)
+	}
+
+	got, err = json.Marshal(struct{ Envelope Envelope }{*env})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := `{"Envelope":` + string(want) + `}`; string(got) != w {
+		t.Errorf("embedded: got %s, want %s", got, w)
+	}
+}
+
+func TestJSONStrict(t *testing.T) {
+	tests := []string{
+		`{"version":"1.0","recipients":[],"body":"","extra":1}`,
+		`{"version":"9.9","recipients":[],"body":""}`,
+		`{"recipients":[],"body":""}`,
+		`{"version":"1.0","body":""}`,
+		`{"version":"1.0","recipients":[{"epubkey":"YQ","dockey":"YQ==","x":1}],"body":""}`,
+		`{"version":"1.0","recipients":[{"epubkey":"YQ==","dockey":"YQ=="}],"body":""}`,
+		`{"version":"1.0","recipients":[],"body":"YQ"}`,
+		`{"version":"1.0","recipients":[],"body":""} {}`,
+	}
+
+	for _, tt := range tests {
+		if err := json.Unmarshal([]byte(tt), &Envelope{}); err == nil {
+			t.Errorf("%s: expected error", tt)
+		}
+	}
+
+	// same limit as the binary encoding
+	rev := `{"pubkey":"YQ","time":"2020-09-13T12:26:40Z"}`
+	tt := `{"version":"1.0","recipients":[],"revocations":[` +
+		strings.Repeat(rev+",", MaxRevocations) + rev + `],"body":""}`
+	if err := json.Unmarshal([]byte(tt), &Envelope{}); !errors.Is(err, ErrMalformedEnvelope) {
+		t.Errorf("too many revocations: got %v", err)
+	}
+}
+
+func TestSchemaLimits(t *testing.T) {
+	data, err := ioutil.ReadFile("envelope.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Properties struct {
+			Recipients, Revocations struct {
+				MaxItems int `json:"maxItems"`
+			}
+		} `json:"properties"`
+		Defs struct {
+			Recipient struct {
+				Properties struct {
+					Label struct {
+						MaxLength int `json:"maxLength"`
+					} `json:"label"`
+				} `json:"properties"`
+			} `json:"recipient"`
+		} `json:"$defs"`
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	// the schema repeats the limits of the codecs
+	if n := schema.Properties.Recipients.MaxItems; n != MaxRecipients {
+		t.Errorf("recipients maxItems %d, want %d", n, MaxRecipients)
+	}
+	if n := schema.Properties.Revocations.MaxItems; n != MaxRevocations {
+		t.Errorf("revocations maxItems %d, want %d", n, MaxRevocations)
+	}
+	if n := schema.Defs.Recipient.Properties.Label.MaxLength; n != MaxLabelSize {
+		t.Errorf("label maxLength %d, want %d", n, MaxLabelSize)
+	}
+}
+
+func TestArmorRoundTrip(t *testing.T) {
+	want := testEnvelope()
+	want.Body = bytes.Repeat([]byte("body"), 100)
+
+	text, err := Armor(want, map[string]string{"Comment": "db password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// indented, CRLF line endings and surrounding whitespace
+	mangled := "\n  " + strings.Replace(string(text), "\n", "\r\n    ", -1) + "\n\n"
+
+	got, headers, err := Dearmor([]byte(mangled))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if headers["Comment"] != "db password" || headers["Version"] != V1 {
+		t.Errorf("unexpected headers %v", headers)
+	}
+}
+
+func TestArmorChecksum(t *testing.T) {
+	text, err := Armor(testEnvelope(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(string(text), "\n")
+	lines[3] = "A" + lines[3][1:]
+	if _, _, err := Dearmor([]byte(strings.Join(lines, "\n"))); err == nil {
+		t.Error("expected checksum error")
+	}
+}
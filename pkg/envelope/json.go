@@ -0,0 +1,291 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// JSON representation, see envelope.schema.json:
+//
+//	{
+//	  "version": "3.0",
+//	  "suite": "xchacha20poly1305",
+//	  "recipients": [
+//	    {
+//	      "pubkey": "<raw base64>",
+//	      "epubkey": "<raw base64>",
+//	      "type": "authcrypt",
+//	      "sender": "<raw base64>",
+//	      "role": "writer",
+//	      "identity": "<raw base64>",
+//	      "label": "laptop",
+//	      "nonce": "<base64>",
+//	      "dockey": "<base64>"
+//	    }
+//	  ],
+//	  "mac": "<base64>",
+//	  "nonce": "<base64>",
+//	  "signer": "<raw base64>",
+//	  "signature": "<base64>",
+//	  "revocations": [
+//	    {"pubkey": "<raw base64>", "time": "2006-01-02T15:04:05Z"}
+//	  ],
+//	  "body": "<base64>"
+//	}
+//
+// Keys use unpadded standard base64, all other binary fields use padded
+// standard base64, times are RFC 3339 in UTC. Optional fields are omitted
+// when empty. Unknown fields, trailing data and unknown versions are
+// rejected when decoding.
+
+var (
+	keyEncoding  = base64.RawStdEncoding.Strict()
+	dataEncoding = base64.StdEncoding.Strict()
+)
+
+type jsonEnvelope struct {
+	Version     string        `json:"version"`
+	Suite       string        `json:"suite,omitempty"`
+	Recipients  []*Recipient  `json:"recipients"`
+	MAC         string        `json:"mac,omitempty"`
+	Nonce       string        `json:"nonce,omitempty"`
+	Signer      string        `json:"signer,omitempty"`
+	Signature   string        `json:"signature,omitempty"`
+	Revocations []*Revocation `json:"revocations,omitempty"`
+	Body        string        `json:"body"`
+}
+
+type jsonRecipient struct {
+	PubKey   string `json:"pubkey,omitempty"`
+	EPubKey  string `json:"epubkey"`
+	Type     string `json:"type,omitempty"`
+	Sender   string `json:"sender,omitempty"`
+	Role     string `json:"role,omitempty"`
+	Identity string `json:"identity,omitempty"`
+	Label    string `json:"label,omitempty"`
+	Nonce    string `json:"nonce,omitempty"`
+	DocKey   string `json:"dockey"`
+}
+
+type jsonRevocation struct {
+	PubKey string `json:"pubkey"`
+	Time   string `json:"time"`
+}
+
+// encode envelope as JSON
+func (e Envelope) MarshalJSON() ([]byte, error) {
+	recipients := e.Recipients
+	if recipients == nil {
+		recipients = []*Recipient{}
+	}
+
+	return json.Marshal(&jsonEnvelope{
+		Version:     e.Version,
+		Suite:       e.Suite,
+		Recipients:  recipients,
+		MAC:         dataEncoding.EncodeToString(e.MAC),
+		Nonce:       dataEncoding.EncodeToString(e.Nonce),
+		Signer:      e.Signer,
+		Signature:   dataEncoding.EncodeToString(e.Signature),
+		Revocations: e.Revocations,
+		Body:        dataEncoding.EncodeToString(e.Body),
+	})
+}
+
+// decode envelope from JSON
+func (e *Envelope) UnmarshalJSON(data []byte) error {
+	var v jsonEnvelope
+	if err := decodeStrict(data, &v); err != nil {
+		return err
+	}
+
+	if v.Version == "" {
+		return malformed("missing version")
+	}
+	if !Supported(v.Version) {
+		return &UnsupportedVersionError{Version: v.Version}
+	}
+	if v.Recipients == nil {
+		return malformed("missing recipients")
+	}
+	if len(v.Recipients) > MaxRecipients {
+		return malformed("too many recipients")
+	}
+	for _, r := range v.Recipients {
+		if r == nil {
+			return malformed("recipient is null")
+		}
+	}
+	if len(v.Revocations) > MaxRevocations {
+		return malformed("too many revocations")
+	}
+	for _, r := range v.Revocations {
+		if r == nil {
+			return malformed("revocation is null")
+		}
+	}
+
+	body, err := dataEncoding.DecodeString(v.Body)
+	if err != nil {
+		return malformed("body: %v", err)
+	}
+	if len(body) > MaxBodySize {
+		return malformed("body too large")
+	}
+
+	mac, err := decodeOptional(v.MAC)
+	if err != nil {
+		return malformed("mac: %v", err)
+	}
+	nonce, err := decodeOptional(v.Nonce)
+	if err != nil {
+		return malformed("nonce: %v", err)
+	}
+	if v.Signer != "" {
+		if _, err := keyEncoding.DecodeString(v.Signer); err != nil {
+			return malformed("signer: %v", err)
+		}
+	}
+	signature, err := decodeOptional(v.Signature)
+	if err != nil {
+		return malformed("signature: %v", err)
+	}
+
+	*e = Envelope{
+		Version:     v.Version,
+		Suite:       v.Suite,
+		Recipients:  v.Recipients,
+		MAC:         mac,
+		Nonce:       nonce,
+		Signer:      v.Signer,
+		Signature:   signature,
+		Revocations: v.Revocations,
+		Body:        body,
+	}
+
+	return nil
+}
+
+// encode recipient as JSON
+func (r Recipient) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonRecipient{
+		PubKey:   r.PubKey,
+		EPubKey:  r.EPubKey,
+		Type:     r.Type,
+		Sender:   r.Sender,
+		Role:     r.Role,
+		Identity: r.Identity,
+		Label:    r.Label,
+		Nonce:    dataEncoding.EncodeToString(r.Nonce),
+		DocKey:   dataEncoding.EncodeToString(r.DocKey),
+	})
+}
+
+// decode recipient from JSON
+func (r *Recipient) UnmarshalJSON(data []byte) error {
+	var v jsonRecipient
+	if err := decodeStrict(data, &v); err != nil {
+		return err
+	}
+
+	if v.PubKey != "" {
+		if _, err := keyEncoding.DecodeString(v.PubKey); err != nil {
+			return malformed("pubkey: %v", err)
+		}
+	}
+	if v.EPubKey == "" {
+		return malformed("missing epubkey")
+	}
+	if _, err := keyEncoding.DecodeString(v.EPubKey); err != nil {
+		return malformed("epubkey: %v", err)
+	}
+	if v.Sender != "" {
+		if _, err := keyEncoding.DecodeString(v.Sender); err != nil {
+			return malformed("sender: %v", err)
+		}
+	}
+	if v.Identity != "" {
+		if _, err := keyEncoding.DecodeString(v.Identity); err != nil {
+			return malformed("identity: %v", err)
+		}
+	}
+	nonce, err := decodeOptional(v.Nonce)
+	if err != nil {
+		return malformed("nonce: %v", err)
+	}
+	docKey, err := dataEncoding.DecodeString(v.DocKey)
+	if err != nil {
+		return malformed("dockey: %v", err)
+	}
+	if len(docKey) == 0 {
+		return malformed("missing dockey")
+	}
+
+	*r = Recipient{
+		PubKey:   v.PubKey,
+		EPubKey:  v.EPubKey,
+		Type:     v.Type,
+		Sender:   v.Sender,
+		Role:     v.Role,
+		Identity: v.Identity,
+		Label:    v.Label,
+		Nonce:    nonce,
+		DocKey:   docKey,
+	}
+
+	return nil
+}
+
+// encode revocation as JSON
+func (r Revocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonRevocation{
+		PubKey: r.PubKey,
+		Time:   r.Time.UTC().Format(time.RFC3339),
+	})
+}
+
+// decode revocation from JSON
+func (r *Revocation) UnmarshalJSON(data []byte) error {
+	var v jsonRevocation
+	if err := decodeStrict(data, &v); err != nil {
+		return err
+	}
+
+	if v.PubKey == "" {
+		return malformed("missing revocation pubkey")
+	}
+	if _, err := keyEncoding.DecodeString(v.PubKey); err != nil {
+		return malformed("revocation pubkey: %v", err)
+	}
+	t, err := time.Parse(time.RFC3339, v.Time)
+	if err != nil {
+		return malformed("revocation time: %v", err)
+	}
+
+	*r = Revocation{PubKey: v.PubKey, Time: t.UTC()}
+
+	return nil
+}
+
+// decode optional base64 field, empty fields decode to nil
+func decodeOptional(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return dataEncoding.DecodeString(s)
+}
+
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return malformed("%v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return malformed("trailing data")
+	}
+	return nil
+}
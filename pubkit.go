@@ -2,11 +2,72 @@ package pubkit
 
 import (
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/speier/pubkit/internal/x25519"
 	"github.com/speier/pubkit/pkg/envelope"
 )
 
+// cipher suites selectable with SealOptions
+const (
+	SuiteChaCha20Poly1305  = "chacha20poly1305"
+	SuiteXChaCha20Poly1305 = "xchacha20poly1305"
+	SuiteAES256GCM         = "aes256gcm"
+)
+
+// options for sealing envelopes
+type SealOptions struct {
+	// associated data, authenticated but not stored in the envelope
+	AD []byte
+	// cipher suite, defaults to SuiteXChaCha20Poly1305
+	Suite string
+	// hide recipient public keys, recipients find their stanza by trial
+	// decryption
+	Anonymous bool
+	// sign the envelope with identity
+	Signer *Identity
+	// sender private key, authcrypts every stanza with it so recipients can
+	// verify the sender with OpenOptions.Sender
+	Sender []byte
+}
+
+// options for opening envelopes
+type OpenOptions struct {
+	// associated data the envelope was sealed with
+	AD []byte
+	// when no stanza is addressed to the private key, try to decrypt every
+	// stanza without a recipient public key, costs a key agreement per stanza
+	TrialDecrypt bool
+	// sender public key, open fails unless the stanza was authcrypted by it
+	Sender []byte
+}
+
+// options for updating envelopes and removing recipients
+type UpdateOptions struct {
+	// associated data the envelope was sealed with
+	AD []byte
+	// public keys of the recipients of an anonymous envelope, which are not
+	// stored in the envelope, required to update it
+	Recipients [][]byte
+	// sign the result with identity, required when the envelope records
+	// revocations so the records stay signed, RevokeWithOptions signs with
+	// its own identity
+	Signer *Identity
+}
+
+// options for appending recipients, the body is not decrypted so no
+// associated data is needed
+type AppendOptions struct {
+	// public keys of the recipients of an anonymous envelope, which are not
+	// stored in the envelope, they only prevent duplicate stanzas, the key
+	// of the private key appending is always known
+	Recipients [][]byte
+	// sign the result with identity, required when the envelope records
+	// revocations so the records stay signed
+	Signer *Identity
+}
+
 // must generate new public/private key pair
 func MustGenerateKeys() ([]byte, []byte) {
 	pub, prv, err := GenerateKeys()
@@ -28,74 +89,276 @@ func GenerateKeys() ([]byte, []byte, error) {
 
 // seal data with recipients public key
 func Seal(data []byte, pubkey ...[]byte) (*envelope.Envelope, error) {
+	return SealWithAD(data, nil, pubkey...)
+}
+
+// seal data with recipients public key and bind it to associated data,
+// ad is not stored in the envelope and must be passed to OpenWithAD
+func SealWithAD(data, ad []byte, pubkey ...[]byte) (*envelope.Envelope, error) {
+	return SealWithOptions(data, &SealOptions{AD: ad}, pubkey...)
+}
+
+// seal data with recipients public key and options
+func SealWithOptions(data []byte, opts *SealOptions, pubkey ...[]byte) (*envelope.Envelope, error) {
+	return seal(data, opts, nil, pubkey...)
+}
+
+// seal data with options, recording labels of child keys keyed by encoded
+// recipient public key
+func seal(data []byte, opts *SealOptions, labels map[string]string, pubkey ...[]byte) (*envelope.Envelope, error) {
+	if opts == nil {
+		opts = &SealOptions{}
+	}
 	if len(data) == 0 {
 		return nil, errors.New("data must be specified")
 	}
 	if len(pubkey) == 0 {
-		return nil, errors.New("one or more public key must be specified")
+		return nil, fmt.Errorf("%w: one or more public key must be specified", ErrInvalidKey)
 	}
 
-	envelope, err := x25519.Seal(data, pubkey...)
+	envelope, err := x25519.Seal(data, &x25519.Options{
+		AD:        opts.AD,
+		Suite:     opts.Suite,
+		Anonymous: opts.Anonymous,
+		Sender:    opts.Sender,
+		Labels:    labels,
+	}, pubkey...)
 	if err != nil {
 		return nil, err
 	}
 
+	if opts.Signer != nil {
+		if err := Sign(envelope, opts.Signer); err != nil {
+			return nil, err
+		}
+	}
+
 	return envelope, nil
 }
 
 // open data with private key
 func Open(envelope *envelope.Envelope, prvkey []byte) ([]byte, error) {
+	return OpenWithAD(envelope, prvkey, nil)
+}
+
+// open data with private key and the associated data it was sealed with
+func OpenWithAD(envelope *envelope.Envelope, prvkey, ad []byte) ([]byte, error) {
+	return OpenWithOptions(envelope, prvkey, &OpenOptions{AD: ad})
+}
+
+// open data with private key and options
+func OpenWithOptions(envelope *envelope.Envelope, prvkey []byte, opts *OpenOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &OpenOptions{}
+	}
 	if envelope == nil {
 		return nil, errors.New("envelope is nil, must be specified")
 	}
 	if len(prvkey) == 0 {
-		return nil, errors.New("private key must be specified")
+		return nil, fmt.Errorf("%w: private key must be specified", ErrInvalidKey)
 	}
 
-	res, err := x25519.Open(envelope, prvkey)
+	res, err := x25519.Open(envelope, prvkey, &x25519.Options{
+		AD:           opts.AD,
+		TrialDecrypt: opts.TrialDecrypt,
+		ExpectSender: opts.Sender,
+	})
 	if err != nil {
 		return nil, err
 	}
-	if len(res) == 0 {
-		return nil, errors.New("failed to open")
-	}
 
 	return res, nil
 }
 
 // open with private key and update data
 func Update(envelope *envelope.Envelope, prvkey []byte, data []byte) (*envelope.Envelope, error) {
+	return UpdateWithAD(envelope, prvkey, data, nil)
+}
+
+// open with private key and update data of an envelope bound to associated data
+func UpdateWithAD(envelope *envelope.Envelope, prvkey, data, ad []byte) (*envelope.Envelope, error) {
+	return UpdateWithOptions(envelope, prvkey, data, &UpdateOptions{AD: ad})
+}
+
+// open with private key and update data with options
+func UpdateWithOptions(envelope *envelope.Envelope, prvkey, data []byte, opts *UpdateOptions) (*envelope.Envelope, error) {
+	if opts == nil {
+		opts = &UpdateOptions{}
+	}
 	if envelope == nil {
 		return nil, errors.New("envelope is nil, must be specified")
 	}
 	if len(prvkey) == 0 {
-		return nil, errors.New("private key must be specified")
+		return nil, fmt.Errorf("%w: private key must be specified", ErrInvalidKey)
 	}
 	if len(data) == 0 {
 		return nil, errors.New("data must be specified")
 	}
+	if managed(envelope) {
+		return nil, fmt.Errorf("%w: envelope has roles, use UpdateSigned", ErrPermissionDenied)
+	}
+	if err := requireSigner(envelope, opts.Signer); err != nil {
+		return nil, err
+	}
 
-	envelope, err := x25519.Update(envelope, prvkey, data)
+	envelope, err := x25519.Update(envelope, prvkey, data, &x25519.Options{AD: opts.AD, Recipients: opts.Recipients})
 	if err != nil {
 		return nil, err
 	}
+	if opts.Signer != nil {
+		if err := Sign(envelope, opts.Signer); err != nil {
+			return nil, err
+		}
+	}
 
 	return envelope, nil
 }
 
-// open with private key and append one or more recipients' public key
+// open with private key and append one or more recipients' public key, the
+// body and the existing recipient stanzas are kept as they are
 func Append(envelope *envelope.Envelope, prvkey []byte, pubkey ...[]byte) (*envelope.Envelope, error) {
+	return AppendWithOptions(envelope, prvkey, nil, pubkey...)
+}
+
+// open with private key and append one or more recipients' public key with options
+func AppendWithOptions(envelope *envelope.Envelope, prvkey []byte, opts *AppendOptions, pubkey ...[]byte) (*envelope.Envelope, error) {
+	return appendRecipients(envelope, prvkey, opts, nil, pubkey...)
+}
+
+// append recipients with options, recording labels of child keys keyed by
+// encoded recipient public key
+func appendRecipients(envelope *envelope.Envelope, prvkey []byte, opts *AppendOptions, labels map[string]string, pubkey ...[]byte) (*envelope.Envelope, error) {
+	if opts == nil {
+		opts = &AppendOptions{}
+	}
 	if envelope == nil {
 		return nil, errors.New("envelope is nil, must be specified")
 	}
 	if len(pubkey) == 0 {
-		return nil, errors.New("one or more public key must be specified")
+		return nil, fmt.Errorf("%w: one or more public key must be specified", ErrInvalidKey)
+	}
+	if managed(envelope) {
+		return nil, fmt.Errorf("%w: envelope has roles, use AppendSigned", ErrPermissionDenied)
+	}
+	if err := requireSigner(envelope, opts.Signer); err != nil {
+		return nil, err
 	}
 
-	envelope, err := x25519.Append(envelope, prvkey, pubkey...)
+	envelope, err := x25519.Append(envelope, prvkey, &x25519.Options{Recipients: opts.Recipients, Labels: labels}, pubkey...)
 	if err != nil {
 		return nil, err
 	}
+	if opts.Signer != nil {
+		if err := Sign(envelope, opts.Signer); err != nil {
+			return nil, err
+		}
+	}
 
 	return envelope, nil
 }
+
+// open with private key and remove one or more recipients' public key, the
+// envelope is resealed under a new master key so removed recipients cannot
+// open later versions
+func Remove(envelope *envelope.Envelope, prvkey []byte, pubkey ...[]byte) (*envelope.Envelope, error) {
+	return RemoveWithAD(envelope, prvkey, nil, pubkey...)
+}
+
+// open with private key and remove one or more recipients' public key from
+// an envelope bound to associated data
+func RemoveWithAD(envelope *envelope.Envelope, prvkey, ad []byte, pubkey ...[]byte) (*envelope.Envelope, error) {
+	return RemoveWithOptions(envelope, prvkey, &UpdateOptions{AD: ad}, pubkey...)
+}
+
+// open with private key and remove one or more recipients' public key with options
+func RemoveWithOptions(envelope *envelope.Envelope, prvkey []byte, opts *UpdateOptions, pubkey ...[]byte) (*envelope.Envelope, error) {
+	if opts == nil {
+		opts = &UpdateOptions{}
+	}
+	if envelope == nil {
+		return nil, errors.New("envelope is nil, must be specified")
+	}
+	if len(pubkey) == 0 {
+		return nil, fmt.Errorf("%w: one or more public key must be specified", ErrInvalidKey)
+	}
+	if managed(envelope) {
+		return nil, fmt.Errorf("%w: envelope has roles, use Revoke", ErrPermissionDenied)
+	}
+	if err := requireSigner(envelope, opts.Signer); err != nil {
+		return nil, err
+	}
+
+	envelope, err := x25519.Remove(envelope, prvkey, &x25519.Options{AD: opts.AD, Recipients: opts.Recipients}, pubkey...)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Signer != nil {
+		if err := Sign(envelope, opts.Signer); err != nil {
+			return nil, err
+		}
+	}
+
+	return envelope, nil
+}
+
+// open with private key, remove one or more recipients' public key and
+// record their removal in the envelope signed by identity, which must hold
+// the admin role if the envelope is managed, anonymous envelopes cannot
+// record removals as that would reveal their recipients, use Remove instead,
+// an envelope records at most envelope.MaxRevocations removals
+func Revoke(envelope *envelope.Envelope, prvkey []byte, id *Identity, pubkey ...[]byte) (*envelope.Envelope, error) {
+	return RevokeWithOptions(envelope, prvkey, id, nil, pubkey...)
+}
+
+// open with private key, remove one or more recipients' public key and
+// record their removal in the envelope signed by identity with options
+func RevokeWithOptions(envelope *envelope.Envelope, prvkey []byte, id *Identity, opts *UpdateOptions, pubkey ...[]byte) (*envelope.Envelope, error) {
+	if opts == nil {
+		opts = &UpdateOptions{}
+	}
+	if envelope == nil {
+		return nil, errors.New("envelope is nil, must be specified")
+	}
+	if id == nil {
+		return nil, errors.New("identity must be specified")
+	}
+	if len(pubkey) == 0 {
+		return nil, fmt.Errorf("%w: one or more public key must be specified", ErrInvalidKey)
+	}
+	if managed(envelope) && !hasRole(envelope, id.PublicKey(), RoleAdmin) {
+		return nil, fmt.Errorf("%w: changing recipients requires the %s role", ErrPermissionDenied, RoleAdmin)
+	}
+
+	envelope, err := x25519.Remove(envelope, prvkey, &x25519.Options{
+		AD:          opts.AD,
+		Recipients:  opts.Recipients,
+		Revocations: revocations(time.Now(), pubkey),
+	}, pubkey...)
+	if err != nil {
+		return nil, err
+	}
+	if err := Sign(envelope, id); err != nil {
+		return nil, err
+	}
+
+	return envelope, nil
+}
+
+// envelopes recording revocations are only changed by a signer, an unsigned
+// result would let any recipient drop or rewrite the records
+func requireSigner(env *envelope.Envelope, id *Identity) error {
+	if len(env.Revocations) > 0 && id == nil {
+		return fmt.Errorf("%w: envelope records revocations, a signer must be specified", ErrPermissionDenied)
+	}
+	return nil
+}
+
+// revocation records of public keys removed at time t
+func revocations(t time.Time, pubkey [][]byte) []*envelope.Revocation {
+	t = t.UTC().Truncate(time.Second)
+	revs := make([]*envelope.Revocation, 0, len(pubkey))
+	for _, pubk := range pubkey {
+		revs = append(revs, &envelope.Revocation{PubKey: b64.EncodeToString(pubk), Time: t})
+	}
+	return revs
+}
@@ -2,9 +2,25 @@ package pubkit
 
 import (
 	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
 	"testing"
+
+	"github.com/speier/pubkit/pkg/envelope"
 )
 
+func mustDecode(s string) []byte {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
 func TestSealOpen(t *testing.T) {
 	// generate public/private key pairs
 	aPub, _ := MustGenerateKeys()
@@ -87,4 +103,1147 @@ func TestAppend(t *testing.T) {
 	if bytes.Compare(doc, want) != 0 {
 		t.Errorf("got %s, want %s", doc, want)
 	}
+
+	// the body and the existing stanza are kept as is
+	if bytes.Compare(modsecret.Body, secret.Body) != 0 {
+		t.Error("body was re-encrypted")
+	}
+	if modsecret.Recipients[0] != secret.Recipients[0] {
+		t.Error("existing stanza was replaced")
+	}
+}
+
+func TestOpenV1(t *testing.T) {
+	// sealed by the v1 implementation
+	prv := mustDecode("2KRZpWXgqwQyO4osUC8uxPhb4r5W8ecwpqnW9xq68yw=")
+	secret := envelope.NewEnvelope(envelope.V1, []*envelope.Recipient{{
+		PubKey:  "UIZ6c9tzdZgxxbg0cZk3SvUYNxaFL8XQGz6hvdqW+QE",
+		EPubKey: "e9xjrARb8ZIodIHAaLLP5bHorI1jylL513szUPfrS3U",
+		DocKey:  mustDecode("zyon5Ac9mP+92rwrBo2rACRKlEGRpldVK/FtoztSConTMv5AHH9hnmM+pNLWqYMC"),
+	}}, mustDecode("apTtfq22ju9JX76+ea5MohT5TPYJeAN0"))
+
+	want := []byte("hello v1")
+	doc, err := Open(secret, prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Compare(doc, want) != 0 {
+		t.Errorf("got %s, want %s", doc, want)
+	}
+}
+
+func TestOpenV2(t *testing.T) {
+	// sealed by the v2 implementation
+	prv := mustDecode("PlDD6pNpyUKJaMBbozNMscHB25V7aGDQMnsswtjLIdA=")
+	secret := envelope.NewEnvelope(envelope.V2, []*envelope.Recipient{{
+		PubKey:  "at03PX6dU6HaZszDR1xQkEgy8o1rtoTB5eQzQzjKzzM",
+		EPubKey: "uDF/mXOP0/+vriYZtUiLGrQjPEqe+yLa8xtwC9KfwlE",
+		DocKey:  mustDecode("olo1OvN5zX2v61tl0tWMO0XtpNe58lVBDB/dhFwyD0ssc+ysVrrGs5T+LCDMAS+i"),
+	}}, mustDecode("m9HQrhm6vNF2x5rPHyQr7y70vntzvAfF"))
+	secret.MAC = mustDecode("F5XD5d7Fbd/MaDuN7G1k25a8Ytu6ULrpenFKg5ZHWus=")
+
+	want := []byte("hello v2")
+	doc, err := Open(secret, prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Compare(doc, want) != 0 {
+		t.Errorf("got %s, want %s", doc, want)
+	}
+
+	// the header MAC is checked
+	secret.MAC[0] ^= 1
+	if _, err := Open(secret, prv); !errors.Is(err, ErrBodyAuthFailed) {
+		t.Errorf("tampered header: got %v", err)
+	}
+}
+
+func TestHeaderTampering(t *testing.T) {
+	aPub, aPrv := MustGenerateKeys()
+	bPub, _ := MustGenerateKeys()
+
+	seal := func() *envelope.Envelope {
+		secret, err := Seal([]byte("hello"), aPub, bPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return secret
+	}
+
+	tests := map[string]func(*envelope.Envelope){
+		"strip recipient": func(e *envelope.Envelope) {
+			e.Recipients = e.Recipients[:1]
+		},
+		"reorder recipients": func(e *envelope.Envelope) {
+			e.Recipients[0], e.Recipients[1] = e.Recipients[1], e.Recipients[0]
+		},
+		"swap recipient": func(e *envelope.Envelope) {
+			e.Recipients[1] = seal().Recipients[1]
+		},
+		"downgrade version": func(e *envelope.Envelope) {
+			e.Version = envelope.V1
+			e.MAC = nil
+		},
+	}
+
+	for name, tamper := range tests {
+		secret := seal()
+		tamper(secret)
+		if _, err := Open(secret, aPrv); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestAssociatedData(t *testing.T) {
+	aPub, aPrv := MustGenerateKeys()
+
+	want := []byte("hello")
+	secret, err := SealWithAD(want, []byte("row-1"), aPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := OpenWithAD(secret, aPrv, []byte("row-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(doc, want) != 0 {
+		t.Errorf("got %s, want %s", doc, want)
+	}
+
+	if _, err := OpenWithAD(secret, aPrv, []byte("row-2")); err == nil {
+		t.Error("mismatched associated data: expected error")
+	}
+	if _, err := Open(secret, aPrv); err == nil {
+		t.Error("missing associated data: expected error")
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	aPub, aPrv := MustGenerateKeys()
+
+	secret, err := Seal([]byte("hello"), aPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.Version != envelope.V3 {
+		t.Errorf("got version %s, want %s", secret.Version, envelope.V3)
+	}
+
+	secret.Version = "9.9"
+	_, err = Open(secret, aPrv)
+
+	var verr *envelope.UnsupportedVersionError
+	if !errors.As(err, &verr) || verr.Version != "9.9" {
+		t.Errorf("got %v, want unsupported version error", err)
+	}
+}
+
+func TestRandomNonces(t *testing.T) {
+	aPub, _ := MustGenerateKeys()
+
+	a, err := Seal([]byte("hello"), aPub, aPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Seal([]byte("hello"), aPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(a.Nonce) != 24 || bytes.Equal(a.Nonce, b.Nonce) {
+		t.Errorf("expected distinct random body nonces, got %x and %x", a.Nonce, b.Nonce)
+	}
+	if len(a.Recipients[0].Nonce) != 24 || bytes.Equal(a.Recipients[0].Nonce, a.Recipients[1].Nonce) {
+		t.Error("expected distinct random recipient nonces")
+	}
+}
+
+func TestSuites(t *testing.T) {
+	aPub, aPrv := MustGenerateKeys()
+	bPub, bPrv := MustGenerateKeys()
+
+	for _, suite := range []string{SuiteChaCha20Poly1305, SuiteXChaCha20Poly1305, SuiteAES256GCM} {
+		want := []byte("hello")
+		secret, err := SealWithOptions(want, &SealOptions{Suite: suite}, aPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret.Suite != suite {
+			t.Errorf("got suite %s, want %s", secret.Suite, suite)
+		}
+
+		// suite is kept when appending recipients
+		secret, err = Append(secret, aPrv, bPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		doc, err := Open(secret, bPrv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Compare(doc, want) != 0 {
+			t.Errorf("%s: got %s, want %s", suite, doc, want)
+		}
+	}
+
+	if _, err := SealWithOptions([]byte("hello"), &SealOptions{Suite: "rot13"}, aPub); err == nil {
+		t.Error("unknown suite: expected error")
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	aPub, aPrv := MustGenerateKeys()
+	_, bPrv := MustGenerateKeys()
+
+	seal := func() *envelope.Envelope {
+		secret, err := Seal([]byte("hello"), aPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return secret
+	}
+
+	if _, err := Open(seal(), bPrv); !errors.Is(err, ErrNoMatchingRecipient) {
+		t.Errorf("not a recipient: got %v", err)
+	}
+
+	secret := seal()
+	secret.Body[0] ^= 1
+	if _, err := Open(secret, aPrv); !errors.Is(err, ErrBodyAuthFailed) {
+		t.Errorf("tampered body: got %v", err)
+	}
+
+	secret = seal()
+	secret.Recipients[0].EPubKey = "!"
+	if _, err := Open(secret, aPrv); !errors.Is(err, ErrMalformedEnvelope) {
+		t.Errorf("malformed stanza: got %v", err)
+	}
+
+	secret = seal()
+	secret.Version = "9.9"
+	if _, err := Open(secret, aPrv); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("unknown version: got %v", err)
+	}
+
+	if _, err := Open(seal(), aPrv[:16]); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("short private key: got %v", err)
+	}
+	if _, err := Seal([]byte("hello"), make([]byte, 32)); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("low order public key: got %v", err)
+	}
+}
+
+func BenchmarkOpen(b *testing.B) {
+	for _, n := range []int{1, 10, 100, 1000} {
+		pubkeys := make([][]byte, n)
+		var prv []byte
+		for i := range pubkeys {
+			pubkeys[i], prv = MustGenerateKeys()
+		}
+
+		// the last recipient is the worst case for a linear scan
+		secret, err := Seal([]byte("hello"), pubkeys...)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprintf("recipients=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := Open(secret, prv); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestAnonymous(t *testing.T) {
+	aPub, aPrv := MustGenerateKeys()
+	bPub, bPrv := MustGenerateKeys()
+	cPub, cPrv := MustGenerateKeys()
+
+	want := []byte("hello")
+	secret, err := SealWithOptions(want, &SealOptions{Anonymous: true}, aPub, bPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range secret.Recipients {
+		if r.PubKey != "" {
+			t.Errorf("recipient public key %s revealed", r.PubKey)
+		}
+	}
+
+	doc, err := Open(secret, bPrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(doc, want) != 0 {
+		t.Errorf("got %s, want %s", doc, want)
+	}
+	if _, err := Open(secret, cPrv); !errors.Is(err, ErrNoMatchingRecipient) {
+		t.Errorf("not a recipient: got %v", err)
+	}
+
+	// the recipient set is needed to reseal
+	if _, err := Update(secret, aPrv, want); err == nil {
+		t.Error("update without recipients: expected error")
+	}
+
+	// but not to append, where it only avoids duplicate stanzas, the own key
+	// is always known
+	if appended, err := Append(secret, aPrv, aPub); err != nil || len(appended.Recipients) != 2 {
+		t.Errorf("append own key: got %d recipients, %v", len(appended.Recipients), err)
+	}
+	secret, err = AppendWithOptions(secret, aPrv, &AppendOptions{Recipients: [][]byte{bPub}}, bPub, cPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret.Recipients) != 3 || !anonymousEnvelope(secret) {
+		t.Error("expected 3 anonymous recipients")
+	}
+
+	for _, prv := range [][]byte{aPrv, bPrv, cPrv} {
+		doc, err := Open(secret, prv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Compare(doc, want) != 0 {
+			t.Errorf("got %s, want %s", doc, want)
+		}
+	}
+}
+
+func anonymousEnvelope(e *envelope.Envelope) bool {
+	for _, r := range e.Recipients {
+		if r.PubKey != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSealSigned(t *testing.T) {
+	aPub, aPrv := MustGenerateKeys()
+	id, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte("hello")
+	secret, err := SealSigned(want, id, aPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, signer, err := OpenVerified(secret, aPrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(doc, want) != 0 {
+		t.Errorf("got %s, want %s", doc, want)
+	}
+	if bytes.Compare(signer, id.PublicKey()) != 0 {
+		t.Errorf("got signer %x, want %x", signer, id.PublicKey())
+	}
+
+	// forged envelope re-signed by another identity
+	other, _ := GenerateIdentity()
+	forged, _ := SealSigned(want, other, aPub)
+	forged.Signer = secret.Signer
+	if _, _, err := OpenVerified(forged, aPrv); !errors.Is(err, ErrSignatureInvalid) {
+		t.Errorf("forged signer: got %v", err)
+	}
+
+	secret.Body[0] ^= 1
+	if _, _, err := OpenVerified(secret, aPrv); !errors.Is(err, ErrSignatureInvalid) {
+		t.Errorf("tampered body: got %v", err)
+	}
+
+	unsigned, _ := Seal(want, aPub)
+	if _, _, err := OpenVerified(unsigned, aPrv); !errors.Is(err, ErrSignatureInvalid) {
+		t.Errorf("unsigned: got %v", err)
+	}
+}
+
+func TestAuthcrypt(t *testing.T) {
+	aPub, aPrv := MustGenerateKeys()
+	bPub, bPrv := MustGenerateKeys()
+	cPub, cPrv := MustGenerateKeys()
+
+	// 'a' sends to 'b'
+	want := []byte("hello")
+	secret, err := SealWithOptions(want, &SealOptions{Sender: aPrv}, bPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := OpenWithOptions(secret, bPrv, &OpenOptions{Sender: aPub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(doc, want) != 0 {
+		t.Errorf("got %s, want %s", doc, want)
+	}
+
+	// claiming to be 'c' does not verify
+	if _, err := OpenWithOptions(secret, bPrv, &OpenOptions{Sender: cPub}); !errors.Is(err, ErrBodyAuthFailed) {
+		t.Errorf("wrong sender: got %v", err)
+	}
+
+	// 'c' cannot forge a stanza from 'a'
+	forged, _ := SealWithOptions(want, &SealOptions{Sender: cPrv}, bPub)
+	forged.Recipients[0].Sender = secret.Recipients[0].Sender
+	if _, err := OpenWithOptions(forged, bPrv, &OpenOptions{Sender: aPub}); !errors.Is(err, ErrBodyAuthFailed) {
+		t.Errorf("forged sender: got %v", err)
+	}
+
+	// unauthenticated envelopes fail when a sender is expected
+	plain, _ := Seal(want, bPub)
+	if _, err := OpenWithOptions(plain, bPrv, &OpenOptions{Sender: aPub}); !errors.Is(err, ErrBodyAuthFailed) {
+		t.Errorf("no sender: got %v", err)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	adminPub, adminPrv := MustGenerateKeys()
+	writerPub, writerPrv := MustGenerateKeys()
+	readerPub, readerPrv := MustGenerateKeys()
+	admin, _ := GenerateIdentity()
+	writer, _ := GenerateIdentity()
+	reader, _ := GenerateIdentity()
+
+	prev, err := SealManaged([]byte("v1"), admin,
+		&Member{PubKey: adminPub, Role: RoleAdmin, Identity: admin.PublicKey()},
+		&Member{PubKey: writerPub, Role: RoleWriter, Identity: writer.PublicKey()},
+		&Member{PubKey: readerPub, Role: RoleReader, Identity: reader.PublicKey()},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(prev); err != nil {
+		t.Fatal(err)
+	}
+
+	// writer can update
+	next, err := UpdateSigned(prev, writerPrv, writer, []byte("v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyUpdate(prev, next); err != nil {
+		t.Errorf("writer update: got %v", err)
+	}
+	if RoleOf(next, reader.PublicKey()) != RoleReader {
+		t.Errorf("roles not kept on update")
+	}
+
+	// reader cannot update, neither through the API nor by re-signing
+	if _, err := UpdateSigned(prev, readerPrv, reader, []byte("v2")); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("reader update: got %v", err)
+	}
+	if _, err := Update(prev, readerPrv, []byte("v2")); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("unsigned update: got %v", err)
+	}
+	forged, _ := UpdateSigned(prev, writerPrv, writer, []byte("v2"))
+	Sign(forged, reader)
+	if err := VerifyUpdate(prev, forged); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("forged update: got %v", err)
+	}
+
+	// only admins change recipients
+	otherPub, otherPrv := MustGenerateKeys()
+	if _, err := AppendSigned(prev, writerPrv, writer, &Member{PubKey: otherPub, Role: RoleReader}); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("writer append: got %v", err)
+	}
+	next, err = AppendSigned(prev, adminPrv, admin, &Member{PubKey: otherPub, Role: RoleReader})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyUpdate(prev, next); err != nil {
+		t.Errorf("admin append: got %v", err)
+	}
+	if doc, err := Open(next, otherPrv); err != nil || bytes.Compare(doc, []byte("v1")) != 0 {
+		t.Errorf("appended member: got %s, %v", doc, err)
+	}
+
+	// writer promoting itself is detected against the previous version
+	promoted, _ := AppendSigned(prev, adminPrv, admin, &Member{PubKey: writerPub, Role: RoleAdmin, Identity: writer.PublicKey()})
+	promoted, _ = UpdateSigned(promoted, writerPrv, writer, []byte("v2"))
+	if err := VerifyUpdate(prev, promoted); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("writer promotion: got %v", err)
+	}
+
+	if _, err := SealManaged([]byte("v1"), writer, &Member{PubKey: writerPub, Role: RoleWriter, Identity: writer.PublicKey()}); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("non-admin seal: got %v", err)
+	}
+
+	// trusted admins anchor a version
+	if _, err := VerifyManaged(prev, admin.PublicKey()); err != nil {
+		t.Errorf("trusted admin: got %v", err)
+	}
+	if _, err := VerifyManaged(next, admin.PublicKey()); err != nil {
+		t.Errorf("trusted admin append: got %v", err)
+	}
+
+	// reader sealing new contents and naming itself admin has a valid
+	// signature, but is neither trusted nor a legitimate update
+	forged, err = SealManaged([]byte("forged"), reader,
+		&Member{PubKey: readerPub, Role: RoleAdmin, Identity: reader.PublicKey()},
+		&Member{PubKey: adminPub, Role: RoleReader},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(forged); err != nil {
+		t.Errorf("forged signature: got %v", err)
+	}
+	if _, err := VerifyManaged(forged, admin.PublicKey()); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("forged envelope: got %v", err)
+	}
+	if err := VerifyUpdate(prev, forged); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("forged envelope update: got %v", err)
+	}
+	// nil stanzas are malformed, not a panic
+	broken := *prev
+	broken.Recipients = append([]*envelope.Recipient{nil}, prev.Recipients...)
+	if _, err := UpdateSigned(&broken, adminPrv, admin, []byte("v2")); !errors.Is(err, ErrMalformedEnvelope) {
+		t.Errorf("nil stanza update: got %v", err)
+	}
+	if _, err := Verify(&broken); !errors.Is(err, ErrMalformedEnvelope) {
+		t.Errorf("nil stanza verify: got %v", err)
+	}
+	if err := VerifyUpdate(prev, &broken); err == nil {
+		t.Error("nil stanza version: expected error")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	aPub, aPrv := MustGenerateKeys()
+	bPub, bPrv := MustGenerateKeys()
+
+	want := []byte("hello")
+	secret, _ := Seal(want, aPub, bPub)
+
+	removed, err := Remove(secret, aPrv, bPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed.Recipients) != 1 {
+		t.Errorf("got %d recipients, want 1", len(removed.Recipients))
+	}
+	if _, err := Open(removed, bPrv); !errors.Is(err, ErrNoMatchingRecipient) {
+		t.Errorf("removed recipient: got %v", err)
+	}
+	doc, err := Open(removed, aPrv)
+	if err != nil || bytes.Compare(doc, want) != 0 {
+		t.Errorf("got %s, %v", doc, err)
+	}
+
+	// removal re-keys, the old stanza of b does not unwrap the new body
+	old := secret.Recipients[1]
+	removed.Recipients = append(removed.Recipients, old)
+	if _, err := Open(removed, bPrv); err == nil {
+		t.Error("old stanza: expected error")
+	}
+
+	if _, err := Remove(secret, aPrv, aPub, bPub); err == nil {
+		t.Error("remove every recipient: expected error")
+	}
+	cPub, _ := MustGenerateKeys()
+	if _, err := Remove(secret, aPrv, cPub); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("not a recipient: got %v", err)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	aPub, aPrv := MustGenerateKeys()
+	bPub, _ := MustGenerateKeys()
+	id, _ := GenerateIdentity()
+
+	secret, _ := Seal([]byte("hello"), aPub, bPub)
+	revoked, err := Revoke(secret, aPrv, id, bPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(revoked); err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked.Revocations) != 1 || revoked.Revocations[0].PubKey != b64.EncodeToString(bPub) {
+		t.Fatalf("got revocations %+v", revoked.Revocations)
+	}
+
+	// revocations stay signed, unsigned changes are refused
+	cPub, _ := MustGenerateKeys()
+	if _, err := Update(revoked, aPrv, []byte("hello again")); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("unsigned update: got %v", err)
+	}
+	if _, err := Append(revoked, aPrv, cPub); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("unsigned append: got %v", err)
+	}
+	if _, err := Remove(revoked, aPrv, aPub); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("unsigned remove: got %v", err)
+	}
+	if _, err := Rotate(revoked, aPrv, aPub, cPub); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("unsigned rotate: got %v", err)
+	}
+	appended, err := AppendWithOptions(revoked, aPrv, &AppendOptions{Signer: id}, cPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(appended); err != nil || len(appended.Revocations) != 1 {
+		t.Errorf("signed append: got %d revocations, %v", len(appended.Revocations), err)
+	}
+
+	// revocations are kept across updates and covered by the header MAC
+	updated, err := UpdateWithOptions(revoked, aPrv, []byte("hello again"), &UpdateOptions{Signer: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(updated); err != nil {
+		t.Errorf("signed update: got %v", err)
+	}
+	if len(updated.Revocations) != 1 {
+		t.Errorf("got %d revocations after update, want 1", len(updated.Revocations))
+	}
+	updated.Revocations = nil
+	if _, err := Open(updated, aPrv); !errors.Is(err, ErrBodyAuthFailed) {
+		t.Errorf("dropped revocations: got %v", err)
+	}
+
+	// associated data is passed through
+	ad := []byte("context")
+	secret, _ = SealWithAD([]byte("hello"), ad, aPub, bPub)
+	revoked, err = RevokeWithOptions(secret, aPrv, id, &UpdateOptions{AD: ad}, bPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := OpenWithAD(revoked, aPrv, ad); err != nil || string(doc) != "hello" {
+		t.Errorf("open with associated data: got %s, %v", doc, err)
+	}
+
+	// anonymous recipients are not revealed by a revocation record
+	secret, _ = SealWithOptions([]byte("hello"), &SealOptions{Anonymous: true}, aPub, bPub)
+	opts := &UpdateOptions{Recipients: [][]byte{aPub, bPub}}
+	if _, err := RevokeWithOptions(secret, aPrv, id, opts, bPub); err == nil {
+		t.Error("anonymous revoke: expected error")
+	}
+	if _, err := RemoveWithOptions(secret, aPrv, opts, bPub); err != nil {
+		t.Errorf("anonymous remove: got %v", err)
+	}
+
+	// revocations are capped, a full envelope can still be updated
+	pubkeys := [][]byte{aPub}
+	for i := 0; i <= envelope.MaxRevocations; i++ {
+		pub, _ := MustGenerateKeys()
+		pubkeys = append(pubkeys, pub)
+	}
+	secret, _ = Seal([]byte("hello"), pubkeys...)
+	if _, err := Revoke(secret, aPrv, id, pubkeys[1:]...); err == nil {
+		t.Error("too many revocations: expected error")
+	}
+	full, err := Revoke(secret, aPrv, id, pubkeys[2:]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UpdateWithOptions(full, aPrv, []byte("hello again"), &UpdateOptions{Signer: id}); err != nil {
+		t.Errorf("update full envelope: got %v", err)
+	}
+	if _, err := Revoke(full, aPrv, id, pubkeys[1]); err == nil {
+		t.Error("revoke on full envelope: expected error")
+	}
+	if _, err := RemoveWithOptions(full, aPrv, &UpdateOptions{Signer: id}, pubkeys[1]); err != nil {
+		t.Errorf("remove on full envelope: got %v", err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	aPub, aPrv := MustGenerateKeys()
+	bPub, bPrv := MustGenerateKeys()
+	nPub, nPrv := MustGenerateKeys()
+
+	want := []byte("hello")
+	ad := []byte("context")
+	secret, _ := SealWithAD(want, ad, aPub, bPub)
+
+	rotated, err := Rotate(secret, bPrv, bPub, nPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &rotated.Body[0] != &secret.Body[0] {
+		t.Error("body was re-encrypted")
+	}
+	if rotated.Recipients[0] != secret.Recipients[0] {
+		t.Error("other stanza was replaced")
+	}
+	if doc, err := OpenWithAD(rotated, nPrv, ad); err != nil || bytes.Compare(doc, want) != 0 {
+		t.Errorf("new key: got %s, %v", doc, err)
+	}
+	if _, err := OpenWithAD(rotated, bPrv, ad); !errors.Is(err, ErrNoMatchingRecipient) {
+		t.Errorf("old key: got %v", err)
+	}
+	if _, err := OpenWithAD(rotated, aPrv, ad); err != nil {
+		t.Errorf("other key: got %v", err)
+	}
+
+	// batch rotation leaves envelopes without the old key alone
+	other, _ := Seal(want, bPub)
+	all, err := RotateAll([]*envelope.Envelope{secret, other}, aPrv, aPub, nPub, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all[1] != other {
+		t.Error("unrelated envelope was changed")
+	}
+	if _, err := OpenWithAD(all[0], nPrv, ad); err != nil {
+		t.Errorf("batch: got %v", err)
+	}
+
+	if _, err := Rotate(secret, aPrv, bPub, aPub); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("existing recipient: got %v", err)
+	}
+	// child key labels are kept, a new root opens the rotated stanza
+	_, oldRoot := MustGenerateKeys()
+	_, newRoot := MustGenerateKeys()
+	oldPub, oldPrv, _ := DeriveChildKeys(oldRoot, "laptop")
+	newPub, _, _ := DeriveChildKeys(newRoot, "laptop")
+	secret, _ = SealForChildren(want, nil, &ChildKey{PubKey: oldPub, Label: "laptop"})
+	rotated, err = Rotate(secret, oldPrv, oldPub, newPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ChildLabel(rotated, newPub) != "laptop" {
+		t.Error("label should be kept")
+	}
+	if doc, err := OpenWithRoot(rotated, newRoot); err != nil || bytes.Compare(doc, want) != 0 {
+		t.Errorf("new root: got %s, %v", doc, err)
+	}
+
+	// authcrypted stanzas stay authcrypted and need the sender private key
+	sPub, sPrv := MustGenerateKeys()
+	secret, _ = SealWithOptions(want, &SealOptions{Sender: sPrv}, bPub)
+	if _, err := Rotate(secret, bPrv, bPub, nPub); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("authcrypt without sender: got %v", err)
+	}
+	if _, err := RotateWithOptions(secret, bPrv, bPub, nPub, &RotateOptions{Sender: aPrv}); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("authcrypt with other sender: got %v", err)
+	}
+	rotated, err = RotateWithOptions(secret, bPrv, bPub, nPub, &RotateOptions{Sender: sPrv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := OpenWithOptions(rotated, nPrv, &OpenOptions{Sender: sPub}); err != nil || bytes.Compare(doc, want) != 0 {
+		t.Errorf("authcrypt: got %s, %v", doc, err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	aPub, aPrv := MustGenerateKeys()
+
+	for _, size := range []int{0, 1, 64 * 1024, 64*1024 + 1, 3*64*1024 + 17} {
+		want := make([]byte, size)
+		for i := range want {
+			want[i] = byte(i)
+		}
+
+		var buf bytes.Buffer
+		w, err := NewSealWriter(&buf, aPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(want); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+
+		r, err := NewOpenReader(bytes.NewReader(data), aPrv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if bytes.Compare(got, want) != 0 {
+			t.Errorf("size %d: stream round trip mismatch", size)
+		}
+
+		// a stream is a binary envelope
+		var env envelope.Envelope
+		if err := env.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := Open(&env, aPrv); err != nil || bytes.Compare(got, want) != 0 {
+			t.Errorf("size %d: open streamed envelope: %v", size, err)
+		}
+
+		// truncation at a chunk boundary or inside a chunk
+		for _, cut := range []int{1, 16, 64*1024 + 16} {
+			if cut >= len(env.Body) {
+				continue
+			}
+			r, err := NewOpenReader(bytes.NewReader(data[:len(data)-cut]), aPrv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ioutil.ReadAll(r); !errors.Is(err, ErrBodyAuthFailed) {
+				t.Errorf("size %d truncated by %d: got %v", size, cut, err)
+			}
+		}
+	}
+}
+
+func TestStreamRandomAccess(t *testing.T) {
+	aPub, aPrv := MustGenerateKeys()
+
+	want := make([]byte, 3*64*1024+17)
+	for i := range want {
+		want[i] = byte(i * 7)
+	}
+	var buf bytes.Buffer
+	w, _ := NewSealWriter(&buf, aPub)
+	w.Write(want)
+	w.Close()
+	data := buf.Bytes()
+
+	r, err := NewOpenReaderAt(bytes.NewReader(data), int64(len(data)), aPrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != int64(len(want)) {
+		t.Fatalf("got size %d, want %d", r.Size(), len(want))
+	}
+
+	// ranges within a chunk, across chunk boundaries and at the end
+	for _, rng := range [][2]int{{0, 10}, {64*1024 - 5, 64*1024 + 5}, {100, 2*64*1024 + 100}, {len(want) - 17, len(want)}} {
+		got := make([]byte, rng[1]-rng[0])
+		if _, err := r.ReadAt(got, int64(rng[0])); err != nil {
+			t.Fatalf("range %v: %v", rng, err)
+		}
+		if bytes.Compare(got, want[rng[0]:rng[1]]) != 0 {
+			t.Errorf("range %v: mismatch", rng)
+		}
+	}
+
+	if _, err := r.Seek(64*1024, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := ioutil.ReadAll(r)
+	if err != nil || bytes.Compare(rest, want[64*1024:]) != 0 {
+		t.Errorf("seek and read: %v", err)
+	}
+
+	// a tampered chunk only fails reads covering it
+	tampered := append([]byte(nil), data...)
+	tampered[len(data)-len(want)-4*16+64*1024+16+10] ^= 1
+	r, err = NewOpenReaderAt(bytes.NewReader(tampered), int64(len(tampered)), aPrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadAt(make([]byte, 10), 0); err != nil {
+		t.Errorf("untouched chunk: got %v", err)
+	}
+	if _, err := r.ReadAt(make([]byte, 10), 64*1024); !errors.Is(err, ErrBodyAuthFailed) {
+		t.Errorf("tampered chunk: got %v", err)
+	}
+
+	// truncation is detected when opening
+	cut := data[:len(data)-64*1024-16-17-16]
+	if _, err := NewOpenReaderAt(bytes.NewReader(cut), int64(len(cut)), aPrv); !errors.Is(err, ErrBodyAuthFailed) {
+		t.Errorf("truncated: got %v", err)
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	_, prv := MustGenerateKeys()
+	pass := []byte("correct horse battery staple")
+	weak := &KeyParams{LogN: 10, R: 8, P: 1}
+
+	data, err := EncryptPrivateKeyWithParams(prv, pass, weak)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecryptPrivateKey(data, pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(got, prv) != 0 {
+		t.Error("decrypted key mismatch")
+	}
+
+	if _, err := DecryptPrivateKey(data, []byte("wrong")); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("wrong passphrase: got %v", err)
+	}
+
+	// parameters are authenticated
+	tampered := append([]byte(nil), data...)
+	tampered[len("PUBKITKEY")+3] = 4
+	if _, err := DecryptPrivateKey(tampered, pass); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("tampered parameters: got %v", err)
+	}
+
+	upgraded, changed, err := UpgradePrivateKey(data, pass, &KeyParams{LogN: 11, R: 8, P: 1})
+	if err != nil || !changed {
+		t.Fatalf("upgrade: changed %v, %v", changed, err)
+	}
+	if params, _ := KeyFileParams(upgraded); params.LogN != 11 {
+		t.Errorf("got upgraded cost %d, want 11", params.LogN)
+	}
+	if _, changed, _ := UpgradePrivateKey(upgraded, pass, weak); changed {
+		t.Error("upgrade to weaker parameters: expected no change")
+	}
+	if got, _ := DecryptPrivateKey(upgraded, pass); bytes.Compare(got, prv) != 0 {
+		t.Error("upgraded key mismatch")
+	}
+	// a parameter lower than the current one is never applied
+	mixed, changed, err := UpgradePrivateKey(upgraded, pass, &KeyParams{LogN: 10, R: 16, P: 1})
+	if err != nil || !changed {
+		t.Fatalf("mixed upgrade: changed %v, %v", changed, err)
+	}
+	if params, _ := KeyFileParams(mixed); params.LogN != 11 || params.R != 16 || params.P != 1 {
+		t.Errorf("got mixed upgrade %+v, want {11 16 1}", params)
+	}
+}
+
+func TestKeyStrings(t *testing.T) {
+	pub, prv := MustGenerateKeys()
+
+	pubs, err := EncodePublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prvs, err := EncodePrivateKey(prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(pubs, "pubkit1") || !strings.HasPrefix(prvs, "PUBKIT-SECRET-KEY-1") {
+		t.Fatalf("got %s, %s", pubs, prvs)
+	}
+
+	if got, err := ParsePublicKey(pubs); err != nil || bytes.Compare(got, pub) != 0 {
+		t.Errorf("parse public key: %v", err)
+	}
+	if got, err := ParsePrivateKey(prvs); err != nil || bytes.Compare(got, prv) != 0 {
+		t.Errorf("parse private key: %v", err)
+	}
+
+	// wrong key type
+	if _, err := ParsePublicKey(prvs); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("private key as public key: got %v", err)
+	}
+	if _, err := ParsePrivateKey(pubs); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("public key as private key: got %v", err)
+	}
+
+	// typo
+	typo := []byte(pubs)
+	if typo[10] == 'q' {
+		typo[10] = 'p'
+	} else {
+		typo[10] = 'q'
+	}
+	if _, err := ParsePublicKey(string(typo)); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("typo: got %v", err)
+	}
+}
+
+func TestTypedKeys(t *testing.T) {
+	prv, err := GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bPub, _ := MustGenerateKeys()
+	pub, err := NewPublicKey(bPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := SealFor([]byte("hello"), pub, prv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := OpenWithKey(secret, prv)
+	if err != nil || string(doc) != "hello" {
+		t.Fatalf("open: %v", err)
+	}
+
+	// public key derivation matches byte keys
+	other, err := NewPrivateKey(prv.Bytes())
+	if err != nil || !other.Equal(prv) || !other.Public().Equal(prv.Public()) {
+		t.Error("keys should be equal")
+	}
+	if prv.Public().Equal(pub) {
+		t.Error("keys should differ")
+	}
+
+	// invalid keys
+	if _, err := NewPublicKey(bPub[:31]); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("short key: got %v", err)
+	}
+	if _, err := NewPublicKey(make([]byte, 32)); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("low-order point: got %v", err)
+	}
+	if _, err := NewPrivateKey(make([]byte, 32)); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("zero private key: got %v", err)
+	}
+
+	// private key is never printed
+	prvs, _ := EncodePrivateKey(prv.Bytes())
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%x", "%X", "%q", "%d"} {
+		for _, v := range []interface{}{prv, *prv} {
+			s := fmt.Sprintf(format, v)
+			if strings.Contains(strings.ToUpper(s), prvs) || strings.Contains(strings.ToLower(s), fmt.Sprintf("%x", prv.Bytes())) {
+				t.Errorf("%s printed private key: %s", format, s)
+			}
+		}
+	}
+	if prv.String() != "PrivateKey("+prv.Public().String()+")" {
+		t.Errorf("got %s", prv)
+	}
+}
+
+func TestDeriveKeys(t *testing.T) {
+	mnemonic, err := GenerateMnemonic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(strings.Fields(mnemonic)); n != 24 {
+		t.Fatalf("got %d words", n)
+	}
+
+	seed, err := MnemonicSeed(mnemonic, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aPub, aPrv, err := DeriveKeys(seed, "encryption/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// same phrase, same keys
+	again, _ := MnemonicSeed(mnemonic, "")
+	pub, prv, _ := DeriveKeys(again, "encryption/0")
+	if bytes.Compare(pub, aPub) != 0 || bytes.Compare(prv, aPrv) != 0 {
+		t.Error("keys should be equal")
+	}
+
+	// other path or passphrase, other keys
+	bPub, _, _ := DeriveKeys(seed, "encryption/1")
+	other, _ := MnemonicSeed(mnemonic, "passphrase")
+	cPub, _, _ := DeriveKeys(other, "encryption/0")
+	if bytes.Compare(bPub, aPub) == 0 || bytes.Compare(cPub, aPub) == 0 {
+		t.Error("keys should differ")
+	}
+
+	secret, err := Seal([]byte("hello"), aPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := Open(secret, aPrv); err != nil || string(doc) != "hello" {
+		t.Errorf("open: %v", err)
+	}
+
+	// known phrase derives fixed keys
+	seed, _ = MnemonicSeed("abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about", "")
+	pub, _, _ = DeriveKeys(seed, "encryption/0")
+	if s, _ := EncodePublicKey(pub); s != "pubkit1rfe7m3egdas0wvdm9ll5pam47l2fs9n4f4gvjujcxy59grvu6y3qxjxpu2" {
+		t.Errorf("got %s", s)
+	}
+
+	// bad checksum
+	if _, err := MnemonicSeed("abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon", ""); !errors.Is(err, ErrInvalidMnemonic) {
+		t.Errorf("got %v", err)
+	}
+	if _, _, err := DeriveKeys(seed, ""); err == nil {
+		t.Error("empty path: expected error")
+	}
+}
+
+func TestChildKeys(t *testing.T) {
+	_, root := MustGenerateKeys()
+	laptopPub, laptopPrv, err := DeriveChildKeys(root, "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciPub, _, _ := DeriveChildKeys(root, "ci")
+	if bytes.Compare(laptopPub, ciPub) == 0 {
+		t.Fatal("child keys should differ")
+	}
+	if pub, _, _ := DeriveChildKeys(root, "laptop"); bytes.Compare(pub, laptopPub) != 0 {
+		t.Fatal("child keys should be equal")
+	}
+
+	bPub, bPrv := MustGenerateKeys()
+	secret, err := SealForChildren([]byte("hello"), nil, &ChildKey{PubKey: laptopPub, Label: "laptop"}, &ChildKey{PubKey: bPub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ChildLabel(secret, laptopPub) != "laptop" || ChildLabel(secret, bPub) != "" {
+		t.Errorf("got labels %q, %q", ChildLabel(secret, laptopPub), ChildLabel(secret, bPub))
+	}
+
+	// root finds the child key, the child key and plain recipients open as usual
+	for _, open := range []func() ([]byte, error){
+		func() ([]byte, error) { return OpenWithRoot(secret, root) },
+		func() ([]byte, error) { return Open(secret, laptopPrv) },
+		func() ([]byte, error) { return Open(secret, bPrv) },
+	} {
+		if doc, err := open(); err != nil || string(doc) != "hello" {
+			t.Errorf("open: %v", err)
+		}
+	}
+	if _, err := OpenWithRoot(secret, bPrv); err != nil {
+		t.Errorf("root that is a recipient: %v", err)
+	}
+	_, other := MustGenerateKeys()
+	if _, err := OpenWithRoot(secret, other); !errors.Is(err, ErrNoMatchingRecipient) {
+		t.Errorf("other root: got %v", err)
+	}
+
+	// labels are authenticated and kept when recipients change
+	tampered := *secret
+	tampered.Recipients = []*envelope.Recipient{secret.Recipients[0], secret.Recipients[1]}
+	r := *tampered.Recipients[0]
+	r.Label = "ci"
+	tampered.Recipients[0] = &r
+	if _, err := Open(&tampered, laptopPrv); !errors.Is(err, ErrBodyAuthFailed) {
+		t.Errorf("changed label: got %v", err)
+	}
+	removed, err := Remove(secret, bPrv, bPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ChildLabel(removed, laptopPub) != "laptop" {
+		t.Error("label should be kept")
+	}
+	if doc, err := OpenWithRoot(removed, root); err != nil || string(doc) != "hello" {
+		t.Errorf("open removed: %v", err)
+	}
+
+	// appended child keys are labelled too
+	plain, _ := Seal([]byte("hello"), bPub)
+	appended, err := AppendChildren(plain, bPrv, nil, &ChildKey{PubKey: ciPub, Label: "ci"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ChildLabel(appended, ciPub) != "ci" {
+		t.Errorf("got label %q", ChildLabel(appended, ciPub))
+	}
+	if doc, err := OpenWithRoot(appended, root); err != nil || string(doc) != "hello" {
+		t.Errorf("open appended: %v", err)
+	}
+
+	if _, err := SealForChildren([]byte("hello"), &SealOptions{Anonymous: true}, &ChildKey{PubKey: laptopPub, Label: "laptop"}); err == nil {
+		t.Error("anonymous: expected error")
+	}
+	anon, _ := SealWithOptions([]byte("hello"), &SealOptions{Anonymous: true}, bPub)
+	if _, err := AppendChildren(anon, bPrv, nil, &ChildKey{PubKey: laptopPub, Label: "laptop"}); err == nil {
+		t.Error("anonymous append: expected error")
+	}
 }
@@ -0,0 +1,295 @@
+package pubkit
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+
+	"github.com/speier/pubkit/internal/x25519"
+	"github.com/speier/pubkit/pkg/envelope"
+)
+
+// Managed envelopes record a role for each recipient. Every version of a
+// managed envelope is signed, updates by an identity holding the writer role
+// and recipient changes by one holding the admin role. The roles are
+// declared by the envelope itself, so they only mean something once a
+// version is trusted: VerifyManaged accepts a version signed by a known
+// admin identity and VerifyUpdate accepts a new version against a trusted
+// previous one. A reader knows the envelope key and can seal a new envelope
+// naming itself admin, which neither of them accepts.
+
+// recipient roles of managed envelopes
+const (
+	RoleReader = envelope.RoleReader
+	RoleWriter = envelope.RoleWriter
+	RoleAdmin  = envelope.RoleAdmin
+)
+
+// recipient of a managed envelope
+type Member struct {
+	// X25519 public key of the recipient
+	PubKey []byte
+	// RoleReader, RoleWriter or RoleAdmin
+	Role string
+	// Ed25519 public key of the recipient's signing identity, required for
+	// writers and admins
+	Identity []byte
+}
+
+// seal data for members with roles and sign it with id, which must be one
+// of the admin members
+func SealManaged(data []byte, id *Identity, members ...*Member) (*envelope.Envelope, error) {
+	if len(data) == 0 {
+		return nil, errors.New("data must be specified")
+	}
+	if id == nil {
+		return nil, errors.New("identity must be specified")
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("%w: one or more member must be specified", ErrInvalidKey)
+	}
+
+	grants, pubkeys, err := memberGrants(members)
+	if err != nil {
+		return nil, err
+	}
+	if g := grantOf(grants, id.PublicKey()); g == nil || g.Role != RoleAdmin {
+		return nil, fmt.Errorf("%w: signing identity must be an admin member", ErrPermissionDenied)
+	}
+
+	envelope, err := x25519.Seal(data, &x25519.Options{Grants: grants}, pubkeys...)
+	if err != nil {
+		return nil, err
+	}
+	if err := Sign(envelope, id); err != nil {
+		return nil, err
+	}
+
+	return envelope, nil
+}
+
+// open with private key and update data of a managed envelope, id must hold
+// the writer or admin role
+func UpdateSigned(envelope *envelope.Envelope, prvkey []byte, id *Identity, data []byte) (*envelope.Envelope, error) {
+	if envelope == nil {
+		return nil, errors.New("envelope is nil, must be specified")
+	}
+	if id == nil {
+		return nil, errors.New("identity must be specified")
+	}
+	if len(data) == 0 {
+		return nil, errors.New("data must be specified")
+	}
+	if !hasRole(envelope, id.PublicKey(), RoleWriter) {
+		return nil, fmt.Errorf("%w: updating requires the %s role", ErrPermissionDenied, RoleWriter)
+	}
+
+	envelope, err := x25519.Update(envelope, prvkey, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := Sign(envelope, id); err != nil {
+		return nil, err
+	}
+
+	return envelope, nil
+}
+
+// open with private key and append members to a managed envelope, or change
+// the role of existing ones, id must hold the admin role
+func AppendSigned(envelope *envelope.Envelope, prvkey []byte, id *Identity, members ...*Member) (*envelope.Envelope, error) {
+	if envelope == nil {
+		return nil, errors.New("envelope is nil, must be specified")
+	}
+	if id == nil {
+		return nil, errors.New("identity must be specified")
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("%w: one or more member must be specified", ErrInvalidKey)
+	}
+	if !hasRole(envelope, id.PublicKey(), RoleAdmin) {
+		return nil, fmt.Errorf("%w: changing recipients requires the %s role", ErrPermissionDenied, RoleAdmin)
+	}
+
+	grants, pubkeys, err := memberGrants(members)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope, err = x25519.Append(envelope, prvkey, &x25519.Options{Grants: grants}, pubkeys...)
+	if err != nil {
+		return nil, err
+	}
+	if err := Sign(envelope, id); err != nil {
+		return nil, err
+	}
+
+	return envelope, nil
+}
+
+// verify that managed envelope is signed by one of the trusted admin
+// identities and that the signer is an admin of it, returns the signer
+func VerifyManaged(envelope *envelope.Envelope, admins ...[]byte) ([]byte, error) {
+	if len(admins) == 0 {
+		return nil, fmt.Errorf("%w: one or more admin identity must be specified", ErrInvalidKey)
+	}
+	if !managed(envelope) {
+		return nil, errors.New("envelope has no roles")
+	}
+
+	signer, err := Verify(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	trusted := false
+	for _, a := range admins {
+		if bytes.Equal(a, signer) {
+			trusted = true
+		}
+	}
+	if !trusted {
+		return nil, fmt.Errorf("%w: signer is not a trusted %s", ErrPermissionDenied, RoleAdmin)
+	}
+	if !hasRole(envelope, signer, RoleAdmin) {
+		return nil, fmt.Errorf("%w: signer is not an %s of the envelope", ErrPermissionDenied, RoleAdmin)
+	}
+
+	return signer, nil
+}
+
+// verify that next is a legitimate new version of the managed envelope prev,
+// it must be signed by a writer of prev, or an admin of prev if its members
+// or their roles changed, prev must be trusted, accepted with VerifyManaged
+// or an earlier VerifyUpdate
+func VerifyUpdate(prev, next *envelope.Envelope) error {
+	if prev == nil || next == nil {
+		return errors.New("envelope is nil, must be specified")
+	}
+	if !managed(prev) {
+		return errors.New("previous envelope has no roles")
+	}
+
+	signer, err := Verify(next)
+	if err != nil {
+		return err
+	}
+
+	if !hasRole(prev, signer, RoleWriter) {
+		return fmt.Errorf("%w: signer is not a %s of the previous version", ErrPermissionDenied, RoleWriter)
+	}
+	if !sameMembers(prev, next) && !hasRole(prev, signer, RoleAdmin) {
+		return fmt.Errorf("%w: signer is not an %s of the previous version", ErrPermissionDenied, RoleAdmin)
+	}
+
+	return nil
+}
+
+// role of the recipient with Ed25519 identity in envelope, empty if none
+func RoleOf(envelope *envelope.Envelope, identity []byte) string {
+	if envelope == nil {
+		return ""
+	}
+	id := b64.EncodeToString(identity)
+	for _, r := range envelope.Recipients {
+		if r != nil && r.Identity != "" && r.Identity == id {
+			return r.Role
+		}
+	}
+	return ""
+}
+
+// check if identity holds role, or a role including it, in envelope
+func hasRole(envelope *envelope.Envelope, identity []byte, role string) bool {
+	return roleRank(RoleOf(envelope, identity)) >= roleRank(role)
+}
+
+func roleRank(role string) int {
+	switch role {
+	case RoleReader:
+		return 1
+	case RoleWriter:
+		return 2
+	case RoleAdmin:
+		return 3
+	}
+	return 0
+}
+
+// check if envelope records recipient roles, nil stanzas are left to the
+// envelope validation
+func managed(envelope *envelope.Envelope) bool {
+	if envelope == nil {
+		return false
+	}
+	for _, r := range envelope.Recipients {
+		if r != nil && r.Role != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// check if both envelopes have the same recipients with the same roles
+func sameMembers(a, b *envelope.Envelope) bool {
+	members := make(map[string]int)
+	for _, r := range a.Recipients {
+		if r == nil {
+			return false
+		}
+		members[r.PubKey+"/"+r.Role+"/"+r.Identity]++
+	}
+	for _, r := range b.Recipients {
+		if r == nil {
+			return false
+		}
+		members[r.PubKey+"/"+r.Role+"/"+r.Identity]--
+	}
+	for _, n := range members {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func memberGrants(members []*Member) (map[string]*x25519.Grant, [][]byte, error) {
+	grants := make(map[string]*x25519.Grant)
+	pubkeys := make([][]byte, 0, len(members))
+	for _, m := range members {
+		if m == nil {
+			return nil, nil, errors.New("member is nil")
+		}
+		switch m.Role {
+		case RoleReader:
+		case RoleWriter, RoleAdmin:
+			if len(m.Identity) != ed25519.PublicKeySize {
+				return nil, nil, fmt.Errorf("%w: %s members need an identity", ErrInvalidKey, m.Role)
+			}
+		default:
+			return nil, nil, fmt.Errorf("unknown role %q", m.Role)
+		}
+		if m.Identity != nil && len(m.Identity) != ed25519.PublicKeySize {
+			return nil, nil, fmt.Errorf("%w: identity must be %d bytes", ErrInvalidKey, ed25519.PublicKeySize)
+		}
+
+		g := &x25519.Grant{Role: m.Role}
+		if m.Identity != nil {
+			g.Identity = b64.EncodeToString(m.Identity)
+		}
+		grants[b64.EncodeToString(m.PubKey)] = g
+		pubkeys = append(pubkeys, m.PubKey)
+	}
+	return grants, pubkeys, nil
+}
+
+func grantOf(grants map[string]*x25519.Grant, identity []byte) *x25519.Grant {
+	id := b64.EncodeToString(identity)
+	for _, g := range grants {
+		if g.Identity == id {
+			return g
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package pubkit
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/speier/pubkit/internal/x25519"
+	"github.com/speier/pubkit/pkg/envelope"
+)
+
+// options for rotating recipient keys
+type RotateOptions struct {
+	// identity signing the rotated envelopes, required for managed envelopes
+	// where it must hold the admin role and for envelopes recording
+	// revocations, otherwise rotated envelopes are returned unsigned
+	Signer *Identity
+	// sender private key of authcrypted stanzas, which cannot be rotated
+	// without it
+	Sender []byte
+}
+
+// open with private key and replace recipient public key old with new,
+// only the envelope key is wrapped again and the body is left untouched, so
+// the associated data of the envelope is not needed, the stanza keeps its
+// role, child key label and type, authcrypted stanzas need RotateOptions.Sender
+func Rotate(envelope *envelope.Envelope, prvkey, old, new []byte) (*envelope.Envelope, error) {
+	return RotateWithOptions(envelope, prvkey, old, new, nil)
+}
+
+// open with private key and replace recipient public key old with new with
+// options
+func RotateWithOptions(envelope *envelope.Envelope, prvkey, old, new []byte, opts *RotateOptions) (*envelope.Envelope, error) {
+	if opts == nil {
+		opts = &RotateOptions{}
+	}
+	if envelope == nil {
+		return nil, errors.New("envelope is nil, must be specified")
+	}
+	if len(prvkey) == 0 {
+		return nil, fmt.Errorf("%w: private key must be specified", ErrInvalidKey)
+	}
+	if managed(envelope) && (opts.Signer == nil || !hasRole(envelope, opts.Signer.PublicKey(), RoleAdmin)) {
+		return nil, fmt.Errorf("%w: changing recipients requires the %s role", ErrPermissionDenied, RoleAdmin)
+	}
+	if err := requireSigner(envelope, opts.Signer); err != nil {
+		return nil, err
+	}
+
+	envelope, err := x25519.Rotate(envelope, prvkey, &x25519.Options{Sender: opts.Sender}, old, new)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Signer != nil {
+		if err := Sign(envelope, opts.Signer); err != nil {
+			return nil, err
+		}
+	}
+
+	return envelope, nil
+}
+
+// rotate recipient public key old to new across envelopes, envelopes that
+// cannot be opened with private key or do not have old as a recipient are
+// returned unchanged, the first other error stops the rotation
+func RotateAll(envelopes []*envelope.Envelope, prvkey, old, new []byte, opts *RotateOptions) ([]*envelope.Envelope, error) {
+	rotated := make([]*envelope.Envelope, 0, len(envelopes))
+	for i, env := range envelopes {
+		r, err := RotateWithOptions(env, prvkey, old, new, opts)
+		if errors.Is(err, ErrNoMatchingRecipient) {
+			r = env
+		} else if err != nil {
+			return nil, fmt.Errorf("envelope %d: %w", i, err)
+		}
+		rotated = append(rotated, r)
+	}
+	return rotated, nil
+}
@@ -0,0 +1,122 @@
+package pubkit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/speier/pubkit/pkg/envelope"
+)
+
+// domain separation prefix of envelope signatures
+const signatureContext = "pubkit envelope signature\x00"
+
+var b64 = base64.RawStdEncoding.Strict()
+
+// Ed25519 signing identity of an envelope sender
+type Identity struct {
+	prvkey ed25519.PrivateKey
+}
+
+// generate new signing identity
+func GenerateIdentity() (*Identity, error) {
+	_, prvkey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{prvkey: prvkey}, nil
+}
+
+// restore signing identity from its 32 byte seed
+func NewIdentity(seed []byte) (*Identity, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%w: identity seed must be %d bytes", ErrInvalidKey, ed25519.SeedSize)
+	}
+	return &Identity{prvkey: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// public key of identity
+func (id *Identity) PublicKey() []byte {
+	return append([]byte(nil), id.prvkey.Public().(ed25519.PublicKey)...)
+}
+
+// seed of identity, keep it secret
+func (id *Identity) Seed() []byte {
+	return id.prvkey.Seed()
+}
+
+// seal data with recipients public key and sign it with identity
+func SealSigned(data []byte, id *Identity, pubkey ...[]byte) (*envelope.Envelope, error) {
+	return SealWithOptions(data, &SealOptions{Signer: id}, pubkey...)
+}
+
+// verify signature and open data with private key, returns the data and the
+// public key of the verified signer
+func OpenVerified(envelope *envelope.Envelope, prvkey []byte) ([]byte, []byte, error) {
+	signer, err := Verify(envelope)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := Open(envelope, prvkey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, signer, nil
+}
+
+// sign envelope with identity, replacing any previous signature
+func Sign(envelope *envelope.Envelope, id *Identity) error {
+	if envelope == nil {
+		return errors.New("envelope is nil, must be specified")
+	}
+	if id == nil {
+		return errors.New("identity must be specified")
+	}
+
+	envelope.Signer = b64.EncodeToString(id.PublicKey())
+	msg, err := signedMessage(envelope)
+	if err != nil {
+		return err
+	}
+	envelope.Signature = ed25519.Sign(id.prvkey, msg)
+
+	return nil
+}
+
+// verify envelope signature, returns the public key of the signer, the roles
+// of a managed envelope are not checked as anyone can sign an envelope
+// declaring its own roles, use VerifyManaged or VerifyUpdate for them
+func Verify(envelope *envelope.Envelope) ([]byte, error) {
+	if envelope == nil {
+		return nil, errors.New("envelope is nil, must be specified")
+	}
+	if envelope.Signer == "" || len(envelope.Signature) == 0 {
+		return nil, fmt.Errorf("%w: envelope is not signed", ErrSignatureInvalid)
+	}
+
+	signer, err := b64.DecodeString(envelope.Signer)
+	if err != nil || len(signer) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: invalid signer public key", ErrMalformedEnvelope)
+	}
+
+	msg, err := signedMessage(envelope)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(signer, msg, envelope.Signature) {
+		return nil, ErrSignatureInvalid
+	}
+	return signer, nil
+}
+
+func signedMessage(envelope *envelope.Envelope) ([]byte, error) {
+	data, err := envelope.SignedData()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(signatureContext), data...), nil
+}
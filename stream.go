@@ -0,0 +1,99 @@
+package pubkit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/speier/pubkit/internal/x25519"
+)
+
+// Streamed envelopes are written in the binary encoding, the header first
+// and the body in chunks of 64 KiB as data is written, so sealing and
+// opening need constant memory. They can also be decoded with
+// UnmarshalBinary and opened with Open when they fit in memory and their
+// body is at most envelope.MaxBodySize, 1 GiB, larger streams can only be
+// opened with NewOpenReader or NewOpenReaderAt.
+
+// seal data written to the returned writer with recipients public key and
+// write the envelope to w, the writer must be closed to finish the envelope
+func NewSealWriter(w io.Writer, pubkey ...[]byte) (io.WriteCloser, error) {
+	return NewSealWriterWithOptions(w, nil, pubkey...)
+}
+
+// seal data written to the returned writer with recipients public key and
+// options, signing is not supported for streams
+func NewSealWriterWithOptions(w io.Writer, opts *SealOptions, pubkey ...[]byte) (io.WriteCloser, error) {
+	if opts == nil {
+		opts = &SealOptions{}
+	}
+	if w == nil {
+		return nil, errors.New("writer must be specified")
+	}
+	if len(pubkey) == 0 {
+		return nil, fmt.Errorf("%w: one or more public key must be specified", ErrInvalidKey)
+	}
+	if opts.Signer != nil {
+		return nil, errors.New("streamed envelopes cannot be signed")
+	}
+
+	return x25519.SealStream(w, &x25519.Options{
+		AD:        opts.AD,
+		Suite:     opts.Suite,
+		Anonymous: opts.Anonymous,
+		Sender:    opts.Sender,
+	}, pubkey...)
+}
+
+// read an envelope from r and open it with private key, the returned reader
+// decrypts the data as it is read, a body that has been tampered with or
+// truncated fails the read where it is detected
+func NewOpenReader(r io.Reader, prvkey []byte) (io.Reader, error) {
+	return NewOpenReaderWithOptions(r, prvkey, nil)
+}
+
+// read an envelope from r and open it with private key and options
+func NewOpenReaderWithOptions(r io.Reader, prvkey []byte, opts *OpenOptions) (io.Reader, error) {
+	if opts == nil {
+		opts = &OpenOptions{}
+	}
+	if r == nil {
+		return nil, errors.New("reader must be specified")
+	}
+	if len(prvkey) == 0 {
+		return nil, fmt.Errorf("%w: private key must be specified", ErrInvalidKey)
+	}
+
+	return x25519.OpenStream(r, prvkey, &x25519.Options{
+		AD:           opts.AD,
+		TrialDecrypt: opts.TrialDecrypt,
+		ExpectSender: opts.Sender,
+	})
+}
+
+// open an envelope of size bytes read from r with private key, the returned
+// reader decrypts and verifies only the chunks covering the data read, so
+// it supports random access and seeking
+func NewOpenReaderAt(r io.ReaderAt, size int64, prvkey []byte) (*io.SectionReader, error) {
+	return NewOpenReaderAtWithOptions(r, size, prvkey, nil)
+}
+
+// open an envelope of size bytes read from r with private key and options
+// for random access
+func NewOpenReaderAtWithOptions(r io.ReaderAt, size int64, prvkey []byte, opts *OpenOptions) (*io.SectionReader, error) {
+	if opts == nil {
+		opts = &OpenOptions{}
+	}
+	if r == nil {
+		return nil, errors.New("reader must be specified")
+	}
+	if len(prvkey) == 0 {
+		return nil, fmt.Errorf("%w: private key must be specified", ErrInvalidKey)
+	}
+
+	return x25519.OpenStreamAt(r, size, prvkey, &x25519.Options{
+		AD:           opts.AD,
+		TrialDecrypt: opts.TrialDecrypt,
+		ExpectSender: opts.Sender,
+	})
+}